@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	defaultAntiPoisonWindow = 100 * time.Millisecond
+	// ipTTLSlack is how far the IP TTL of a reply may drift from the one
+	// learned, as routes change by a hop or two.
+	ipTTLSlack = 2
+)
+
+// AntiPoison guards a udp TcpUdpUpstream against injected replies. Instead of
+// taking the first reply, it keeps listening for Window after the first
+// plausible one and returns the best reply seen, later ones winning ties, as
+// forged replies usually arrive before the real one.
+//
+// Replies are dropped outright when their ID, question or (with Use0x20) the
+// letter case of the question differ from the query, when an A or AAAA record
+// falls in BogusNets, or when a returned client cookie is not ours. Replies
+// with traits of forgery are dropped too, or with KeepSuspicious kept only as
+// a last resort: no OPT record although one was sent, no server cookie once
+// the server has sent one before, and with CheckIPTTL an IP TTL (hop limit)
+// other than that of the server's earlier replies, as injected packets are
+// sent from elsewhere on the path.
+type AntiPoison struct {
+	Window         time.Duration
+	BogusNets      *IPSet
+	Use0x20        bool
+	Cookies        bool
+	KeepSuspicious bool
+	CheckIPTTL     bool
+
+	sync.Mutex
+	clientCookie string
+	serverCookie string
+	// ipTTL is the IP TTL of the last reply taken, 0 if not known yet.
+	ipTTL int
+}
+
+func (a *AntiPoison) isBogus(r *dns.Msg) bool {
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if a.BogusNets.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AntiPoison) cookie() string {
+	a.Lock()
+	defer a.Unlock()
+	if a.clientCookie == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		a.clientCookie = hex.EncodeToString(b)
+	}
+	return a.clientCookie + a.serverCookie
+}
+
+// checkCookie reports whether r carries an acceptable cookie, and whether it
+// carries one at all.
+func (a *AntiPoison) checkCookie(r *dns.Msg) (ok bool, present bool) {
+	o := r.IsEdns0()
+	if o == nil {
+		return true, false
+	}
+	for _, opt := range o.Option {
+		c, isCookie := opt.(*dns.EDNS0_COOKIE)
+		if !isCookie {
+			continue
+		}
+		a.Lock()
+		defer a.Unlock()
+		if len(c.Cookie) < 16 || !strings.EqualFold(c.Cookie[:16], a.clientCookie) {
+			return false, true
+		}
+		if len(c.Cookie) > 16 {
+			a.serverCookie = c.Cookie[16:]
+		}
+		return true, true
+	}
+	return true, false
+}
+
+func (a *AntiPoison) knowsServerCookie() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.serverCookie != ""
+}
+
+// checkIPTTL reports whether ttl, the IP TTL of a reply or -1 if unknown, is
+// near the one learned from earlier replies.
+func (a *AntiPoison) checkIPTTL(ttl int) bool {
+	a.Lock()
+	defer a.Unlock()
+	return ttl < 0 || a.ipTTL == 0 || ttl >= a.ipTTL-ipTTLSlack && ttl <= a.ipTTL+ipTTLSlack
+}
+
+// learnIPTTL remembers the IP TTL of a reply taken, or forgets the learned
+// one with ttl 0, so that a value learned from a forged reply does not shut
+// out the server for good.
+func (a *AntiPoison) learnIPTTL(ttl int) {
+	if ttl < 0 {
+		return
+	}
+	a.Lock()
+	a.ipTTL = ttl
+	a.Unlock()
+}
+
+// ipTTLReader returns a read function for conn that also returns the IP TTL
+// of each packet, -1 where it cannot be had.
+func ipTTLReader(conn net.Conn) func([]byte) (int, int, error) {
+	plain := func(b []byte) (int, int, error) {
+		n, err := conn.Read(b)
+		return n, -1, err
+	}
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return plain
+	}
+	if addr, _ := uc.RemoteAddr().(*net.UDPAddr); addr != nil && addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(uc)
+		if err := p.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			return plain
+		}
+		return func(b []byte) (int, int, error) {
+			n, cm, _, err := p.ReadFrom(b)
+			if cm == nil {
+				return n, -1, err
+			}
+			return n, cm.TTL, err
+		}
+	}
+	p := ipv6.NewPacketConn(uc)
+	if err := p.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+		return plain
+	}
+	return func(b []byte) (int, int, error) {
+		n, cm, _, err := p.ReadFrom(b)
+		if cm == nil {
+			return n, -1, err
+		}
+		return n, cm.HopLimit, err
+	}
+}
+
+// randomizeCase flips the case of each letter in name at random (draft-vixie-dnsext-dns0x20).
+func randomizeCase(name string) string {
+	b := []byte(name)
+	rnd := make([]byte, len(b))
+	rand.Read(rnd)
+	for i, c := range b {
+		if rnd[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// exchangeGuarded is the udp exchange used when t.AntiPoison is set.
+func (t *TcpUdpUpstream) exchangeGuarded(ctx context.Context, m *dns.Msg, udpSize uint16) (*dns.Msg, error) {
+	a := t.AntiPoison
+	origName := m.Question[0].Name
+	m = m.Copy()
+	m.Id = uint16(atomic.AddUint32(&t.trId, 1))
+	if a.Use0x20 {
+		m.Question[0].Name = randomizeCase(origName)
+	}
+	if a.Cookies {
+		o := m.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: a.cookie()})
+	}
+	sentOpt := m.IsEdns0() != nil
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialContext(ctx, func() (net.Conn, error) { return t.dial("udp") })
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %v", err)
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+	deadline := time.Now().Add(t.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, fmt.Errorf("Write: %v", err)
+	}
+
+	window := a.Window
+	if window == 0 {
+		window = defaultAntiPoisonWindow
+	}
+	read := func(b []byte) (int, int, error) {
+		n, err := conn.Read(b)
+		return n, -1, err
+	}
+	if a.CheckIPTTL {
+		read = ipTTLReader(conn)
+	}
+	var best *dns.Msg
+	bestScore, bestTTL, droppedTTL := 0, -1, false
+	readBuf := make([]byte, udpSize)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, ipTTL, err := read(readBuf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("Read: %v", err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(readBuf[:n]); err != nil {
+			continue
+		}
+		if r.Id != m.Id || len(r.Question) != 1 || r.Question[0].Qtype != m.Question[0].Qtype || !strings.EqualFold(r.Question[0].Name, m.Question[0].Name) {
+			continue
+		}
+		reason, suspicion := "", ""
+		if a.Use0x20 && r.Question[0].Name != m.Question[0].Name {
+			reason = "0x20 case mismatch"
+		} else if a.isBogus(r) {
+			reason = "bogus ip"
+		} else if a.Cookies {
+			if ok, present := a.checkCookie(r); !ok {
+				reason = "cookie mismatch"
+			} else if !present && a.knowsServerCookie() {
+				suspicion = "no server cookie"
+			}
+		}
+		if reason == "" && sentOpt && r.IsEdns0() == nil {
+			suspicion = "no edns echo"
+		}
+		if reason == "" && !a.checkIPTTL(ipTTL) {
+			suspicion = fmt.Sprintf("ip ttl %d", ipTTL)
+			droppedTTL = true
+		}
+		score := 2
+		if suspicion != "" {
+			if !a.KeepSuspicious {
+				reason = suspicion
+			}
+			score = 1
+		}
+		if reason != "" {
+			log.Printf("%s dropped reply for %s: %s", t.Name(), origName, reason)
+			continue
+		}
+		if best == nil {
+			// Stop waiting shortly after the first plausible reply.
+			if end := time.Now().Add(window); end.Before(deadline) {
+				deadline = end
+			}
+		}
+		if score >= bestScore {
+			best, bestScore, bestTTL = r, score, ipTTL
+		}
+	}
+	if best == nil {
+		if droppedTTL {
+			a.learnIPTTL(0)
+		}
+		return nil, errors.New("ReadMsg: no acceptable reply")
+	}
+	if bestScore == 2 {
+		a.learnIPTTL(bestTTL)
+	}
+	restoreCase(best, origName)
+	return best, nil
+}
+
+// restoreCase puts the original spelling of name back after 0x20.
+func restoreCase(r *dns.Msg, name string) {
+	for i := range r.Question {
+		if strings.EqualFold(r.Question[i].Name, name) {
+			r.Question[i].Name = name
+		}
+	}
+	for _, rr := range r.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, name) {
+			h.Name = name
+		}
+	}
+}
+
+// NewAntiPoison builds an AntiPoison from c, reporting errors under path.
+func NewAntiPoison(path string, c *AntiPoisonConfig) (*AntiPoison, error) {
+	a := &AntiPoison{
+		Window:         time.Duration(c.WindowMs) * time.Millisecond,
+		BogusNets:      NewIPSet(),
+		Use0x20:        c.Use0x20,
+		Cookies:        c.Cookies,
+		KeepSuspicious: c.KeepSuspicious,
+		CheckIPTTL:     c.CheckIPTTL,
+	}
+	if err := a.BogusNets.AddStrings(path+".bogus_ips", c.BogusIPs); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseIPNet parses a CIDR or a single IP.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("want an IP or a CIDR, got %q", s)
+	}
+	return n, nil
+}
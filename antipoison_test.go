@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// testReply is a reply sent by startScriptedServer.
+type testReply struct {
+	ipTTL int
+	edns  bool
+	ip    string
+}
+
+// startScriptedServer runs a UDP server that answers each query with the
+// replies received from script, in order, each with its own IP TTL.
+func startScriptedServer(t *testing.T, script <-chan []testReply) string {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	p := ipv4.NewPacketConn(pc)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			for _, r := range <-script {
+				m := new(dns.Msg)
+				m.SetReply(req)
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + r.ip)
+				m.Answer = []dns.RR{rr}
+				if r.edns {
+					m.SetEdns0(dns.DefaultMsgSize, false)
+				}
+				out, _ := m.Pack()
+				p.SetTTL(r.ipTTL)
+				pc.WriteTo(out, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestAntiPoison(t *testing.T) {
+	script := make(chan []testReply, 1)
+	addr := startScriptedServer(t, script)
+	a := &AntiPoison{
+		Window:     200 * time.Millisecond,
+		BogusNets:  NewIPSet(),
+		CheckIPTTL: true,
+	}
+	u := &TcpUdpUpstream{
+		NameServer: addr,
+		Network:    "udp",
+		Dial:       directDial,
+		Timeout:    time.Second,
+		AntiPoison: a,
+	}
+	for _, c := range []struct {
+		name    string
+		keep    bool
+		replies []testReply
+		want    string
+	}{
+		// The first reply teaches the server's IP TTL.
+		{"genuine", false, []testReply{{64, true, "192.0.2.1"}}, "192.0.2.1"},
+		{"forged ip ttl", false, []testReply{{64, true, "192.0.2.1"}, {30, true, "203.0.113.1"}}, "192.0.2.1"},
+		{"no edns echo", false, []testReply{{64, false, "203.0.113.1"}}, ""},
+		{"no edns echo kept", true, []testReply{{64, false, "203.0.113.1"}}, "203.0.113.1"},
+		{"edns echo preferred", true, []testReply{{64, true, "192.0.2.1"}, {64, false, "203.0.113.1"}}, "192.0.2.1"},
+	} {
+		a.KeepSuspicious = c.keep
+		script <- c.replies
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		r, err := u.Exchange(context.Background(), m)
+		got := ""
+		if err == nil && len(r.Answer) == 1 {
+			got = r.Answer[0].(*dns.A).A.String()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q (%v), want %q", c.name, got, err, c.want)
+		}
+	}
+}
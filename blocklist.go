@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBlocklistRefresh = 24 * time.Hour
+	blocklistRetry          = 5 * time.Minute
+)
+
+// Blocklist is a list of blocked names and exceptions. Lists read from a URL
+// are fetched in the background, first right after they are built and then
+// every refresh period, or sooner after a failure. Until a fetch succeeds
+// they keep the previous rules, which on a reload may be those of the list
+// being replaced.
+type Blocklist struct {
+	Name   string
+	config BlocklistConfig
+	// proxy is the definition of the proxy config.Proxy names.
+	proxy string
+	// fetch is nil for lists read from a file.
+	fetch   func() (io.ReadCloser, error)
+	refresh time.Duration
+
+	rules atomic.Value // *blockRules
+
+	sync.Mutex
+	// refs counts the states using a URL list. The refresh stops, closing
+	// stop, when the last one releases it.
+	refs int
+	stop chan struct{}
+}
+
+// blockRules holds normalized domains. Hosts and plain lists block names
+// exactly, AdBlock ||domain^ rules also block subdomains, and @@ rules make
+// exceptions that apply across all lists.
+type blockRules struct {
+	exact       map[string]bool
+	suffix      map[string]bool
+	allowExact  map[string]bool
+	allowSuffix map[string]bool
+	count       int
+}
+
+func newBlockRules() *blockRules {
+	return &blockRules{
+		exact:       make(map[string]bool),
+		suffix:      make(map[string]bool),
+		allowExact:  make(map[string]bool),
+		allowSuffix: make(map[string]bool),
+	}
+}
+
+func matchSuffix(set map[string]bool, name string) bool {
+	if len(set) == 0 {
+		return false
+	}
+	for {
+		if set[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+func (r *blockRules) blocks(name string) bool {
+	return r.exact[name] || matchSuffix(r.suffix, name)
+}
+
+func (r *blockRules) allows(name string) bool {
+	return r.allowExact[name] || matchSuffix(r.allowSuffix, name)
+}
+
+// parseBlocklist reads a list in hosts, plain or adblock format. Rules it does
+// not understand, such as regexes and cosmetic filters, are skipped.
+func parseBlocklist(r io.Reader, format string) (*blockRules, error) {
+	rules := newBlockRules()
+	add := func(set map[string]bool, domain string) {
+		domain = normalizeDomain(domain)
+		if _, ok := dns.IsDomainName(domain); !ok || strings.IndexByte(domain, '.') < 0 || net.ParseIP(domain) != nil {
+			return
+		}
+		if !set[domain] {
+			set[domain] = true
+			rules.count++
+		}
+	}
+	hostsLine := func(fields []string) {
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return
+		}
+		for _, name := range fields[1:] {
+			if name != "localhost.localdomain" {
+				add(rules.exact, name)
+			}
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch format {
+		case "hosts":
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			hostsLine(strings.Fields(line))
+		case "plain":
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			add(rules.exact, line)
+		case "adblock":
+			if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+				continue
+			}
+			set, allowSet := rules.suffix, rules.allowSuffix
+			exact, allowExact := rules.exact, rules.allowExact
+			if strings.HasPrefix(line, "@@") {
+				line, set, exact = line[2:], allowSet, allowExact
+			}
+			if i := strings.IndexByte(line, '$'); i >= 0 {
+				line = line[:i]
+			}
+			switch {
+			case strings.HasPrefix(line, "||") && strings.HasSuffix(line, "^"):
+				if domain := line[2 : len(line)-1]; !strings.ContainsAny(domain, "*/|^") {
+					add(set, domain)
+				}
+			case strings.ContainsAny(line, "*/|^# \t"):
+				if fields := strings.Fields(line); len(fields) >= 2 {
+					hostsLine(fields)
+				}
+			default:
+				add(exact, line)
+			}
+		default:
+			return nil, fmt.Errorf("unknown format %q, want hosts, plain or adblock", format)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (b *Blocklist) current() *blockRules {
+	return b.rules.Load().(*blockRules)
+}
+
+// update fetches the list, keeping the current rules if that fails.
+func (b *Blocklist) update() error {
+	rules, err := b.load()
+	if err != nil {
+		log.Printf("blocklist %s: fetch %s failed: %v", b.Name, b.config.URL, err)
+		return err
+	}
+	b.setRules(rules)
+	log.Printf("blocklist %s: loaded %d rules from %s", b.Name, rules.count, b.config.URL)
+	return nil
+}
+
+// refreshLoop fetches the list, and then again every refresh period, or
+// retry period after a failure, until the list is released.
+func (b *Blocklist) refreshLoop() {
+	for {
+		next := b.refresh
+		if err := b.update(); err != nil {
+			next = blocklistRetry
+		}
+		t := time.NewTimer(next)
+		select {
+		case <-b.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (b *Blocklist) acquire() {
+	b.Lock()
+	b.refs++
+	b.Unlock()
+}
+
+func (b *Blocklist) release() {
+	b.Lock()
+	defer b.Unlock()
+	if b.refs--; b.refs == 0 {
+		close(b.stop)
+	}
+}
+
+func (b *Blocklist) load() (*blockRules, error) {
+	var rc io.ReadCloser
+	var err error
+	if b.fetch != nil {
+		rc, err = b.fetch()
+	} else {
+		rc, err = os.Open(b.config.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return parseBlocklist(rc, b.config.Format)
+}
+
+func (b *Blocklist) setRules(rules *blockRules) {
+	b.rules.Store(rules)
+	metricBlocklistRules.WithLabelValues(b.Name).Set(float64(rules.count))
+}
+
+// newBlocklist builds the list name from c. A URL list from old with the same
+// config and proxy definition is reused, keeping its rules and refresh
+// schedule; one with another config lends its rules to the new list until
+// the first fetch succeeds.
+func (s *HandlerState) newBlocklist(path, name string, c *BlocklistConfig, proxies *proxySet, old *HandlerState) (*Blocklist, error) {
+	if c.URL == "" {
+		return nil, configError(path+".url", errors.New("missing"))
+	}
+	switch c.Format {
+	case "":
+		c.Format = "hosts"
+	case "hosts", "plain", "adblock":
+	default:
+		return nil, configError(path+".format", fmt.Errorf("unknown format %q, want hosts, plain or adblock", c.Format))
+	}
+	b := &Blocklist{
+		Name:    name,
+		config:  *c,
+		refresh: time.Duration(c.RefreshMin) * time.Minute,
+	}
+	if b.refresh == 0 {
+		b.refresh = defaultBlocklistRefresh
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		if c.Proxy != "" {
+			return nil, configError(path+".proxy", errors.New("only applies to urls"))
+		}
+		rules, err := b.load()
+		if err != nil {
+			return nil, configError(path, err)
+		}
+		b.setRules(rules)
+		s.files = append(s.files, c.URL)
+		return b, nil
+	}
+
+	proxy := c.Proxy
+	if proxy == "" {
+		proxy = "global"
+	}
+	b.proxy = fmt.Sprint(proxies.specs[proxy])
+	var replaced *Blocklist
+	if old != nil {
+		for _, ob := range old.blocklists {
+			if ob.Name != name || ob.fetch == nil {
+				continue
+			}
+			if ob.config == *c && ob.proxy == b.proxy {
+				ob.acquire()
+				s.closers = append(s.closers, ob.release)
+				return ob, nil
+			}
+			replaced = ob
+		}
+	}
+	dial, err := s.selectDial(c.Proxy, true, proxies)
+	if err != nil {
+		return nil, configError(path+".proxy", err)
+	}
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout: 10 * time.Second,
+		}).Dial
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: dial,
+		},
+		Timeout: time.Minute,
+	}
+	b.fetch = func() (io.ReadCloser, error) {
+		resp, err := client.Get(c.URL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("status %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	if replaced != nil && replaced.config.URL == c.URL && replaced.config.Format == c.Format {
+		b.setRules(replaced.current())
+	} else {
+		b.setRules(newBlockRules())
+	}
+	if inspectOnly {
+		return b, nil
+	}
+	b.refs, b.stop = 1, make(chan struct{})
+	s.closers = append(s.closers, b.release)
+	go b.refreshLoop()
+	return b, nil
+}
+
+// blockedBy returns the name of the first list in lists blocking name, or ""
+// if none does or any list has an exception for it.
+func blockedBy(lists []*Blocklist, name string) string {
+	if len(lists) == 0 {
+		return ""
+	}
+	name = normalizeDomain(name)
+	rules := make([]*blockRules, len(lists))
+	for i, b := range lists {
+		rules[i] = b.current()
+		if rules[i].allows(name) {
+			return ""
+		}
+	}
+	for i, r := range rules {
+		if r.blocks(name) {
+			metricBlocklistHits.WithLabelValues(lists[i].Name).Inc()
+			return lists[i].Name
+		}
+	}
+	return ""
+}
+
+// blockReply answers question qi of req as Config.BlockResponse says.
+func (s *HandlerState) blockReply(req *dns.Msg, qi int) *dns.Msg {
+	switch s.blockResponse {
+	case "refused":
+		return localReply(req, qi, dns.RcodeRefused)
+	case "null":
+		m := localReply(req, qi, dns.RcodeSuccess)
+		q := m.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+		return m
+	}
+	return localReply(req, qi, dns.RcodeNameError)
+}
@@ -22,7 +22,16 @@ func questionKey(q dns.Question) string {
 	return fmt.Sprintf("%s%d%d", q.Name, q.Qclass, q.Qtype)
 }
 
-func (d *DNSCache) Put(q dns.Question, m *dns.Msg) {
+func cacheKey(q dns.Question, subnet string) string {
+	if subnet == "" {
+		return questionKey(q)
+	}
+	return questionKey(q) + "/" + subnet
+}
+
+// Put stores m as the answer to q for queries sending subnet, which is "" for
+// those whose answer does not depend on the client.
+func (d *DNSCache) Put(q dns.Question, subnet string, m *dns.Msg) {
 	if d.cache.Capacity() == 0 {
 		return
 	}
@@ -34,11 +43,11 @@ func (d *DNSCache) Put(q dns.Question, m *dns.Msg) {
 		}
 	}
 
-	d.cache.Set(questionKey(q), m, time.Now().Add(time.Duration(minTTL)*time.Second))
+	d.cache.Set(cacheKey(q, subnet), m, time.Now().Add(time.Duration(minTTL)*time.Second))
 }
 
-func (d *DNSCache) Get(q dns.Question) *dns.Msg {
-	v, _ := d.cache.GetNotStale(questionKey(q))
+func (d *DNSCache) Get(q dns.Question, subnet string) *dns.Msg {
+	v, _ := d.cache.GetNotStale(cacheKey(q, subnet))
 	if v != nil {
 		return v.(*dns.Msg).Copy()
 	} else {
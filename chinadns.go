@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// ChinaDNSUpstream queries Domestic and Trusted at the same time. The domestic
+// answer is used when every A and AAAA record in it falls in CNNets, as those
+// are both unlikely to be forged and likely to be nearer than what an overseas
+// resolver returns. Otherwise the trusted answer is used, falling back to the
+// domestic one only if Trusted fails. Other query types go to Trusted alone.
+type ChinaDNSUpstream struct {
+	Domestic []Upstream
+	Trusted  []Upstream
+	CNNets   *IPSet
+	// Options returns the timeout and ECS policy of each member.
+	Options func(Upstream) UpstreamOptions
+}
+
+func (c *ChinaDNSUpstream) Name() string {
+	return "chinadns"
+}
+
+func (c *ChinaDNSUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if qt := m.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+		return c.exchangeAny(ctx, c.Trusted, m)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	trusted := make(chan result, 1)
+	go func() {
+		r, err := c.exchangeAny(ctx, c.Trusted, m)
+		trusted <- result{r, err}
+	}()
+	r, err := c.exchangeAny(ctx, c.Domestic, m)
+	if err == nil && c.isDomestic(r) {
+		return r, nil
+	}
+	t := <-trusted
+	if t.err != nil && err == nil {
+		log.Printf("%s: trusted upstreams failed for %s, using domestic answer: %v", c.Name(), m.Question[0].Name, t.err)
+		return r, nil
+	}
+	return t.r, t.err
+}
+
+// exchangeAny tries ups in order until one answers.
+func (c *ChinaDNSUpstream) exchangeAny(ctx context.Context, ups []Upstream, m *dns.Msg) (r *dns.Msg, err error) {
+	err = errors.New("no upstream")
+	for _, u := range ups {
+		mm := m.Copy()
+		opts := c.Options(u)
+		src := ecsSourceFrom(ctx)
+		src.policy(opts.ECS).Apply(mm, src)
+		if r, _, err = exchange(ctx, u, mm, opts.Timeout); err == nil {
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (c *ChinaDNSUpstream) isDomestic(r *dns.Msg) bool {
+	if r.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	found := false
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if !c.CNNets.Contains(rr.A) {
+				return false
+			}
+			found = true
+		case *dns.AAAA:
+			if !c.CNNets.Contains(rr.AAAA) {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
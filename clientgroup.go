@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// clientGroup is the per-client policy built from a ClientGroupConfig.
+type clientGroup struct {
+	name    string
+	clients *IPSet
+	// routes is nil if the group has no mapping. Its default route is nil
+	// unless the mapping has a "" key, so names it does not match fall
+	// through to the top-level rules.
+	routes *routeTable
+	// ecs replaces the upstreams' policy if not nil.
+	ecs *ECSPolicy
+	// blocklist matches blocked names, using an empty upstream list as the
+	// mark of a match.
+	blocklist *routeTable
+	// blocklists replaces HandlerState.blocklists if ownBlocklists is set.
+	blocklists    []*Blocklist
+	ownBlocklists bool
+	log           string
+	// cache is not nil if the group's answers may differ from others'.
+	cache *DNSCache
+}
+
+// newClientGroups builds the groups from config, reusing the caches of old.
+func (s *HandlerState) newClientGroups(config *Config, named map[string]Upstream, defaultUpstream Upstream, old *HandlerState) error {
+	names := make([]string, 0, len(config.ClientGroups))
+	for name := range config.ClientGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "client_groups." + name
+		c := config.ClientGroups[name]
+		if c == nil {
+			return configError(path, errors.New("must be an object"))
+		}
+		g := &clientGroup{
+			name:    name,
+			clients: NewIPSet(),
+			log:     c.Log,
+		}
+		if err := g.clients.AddStrings(path+".clients", c.Clients); err != nil {
+			return err
+		}
+		if g.clients.Len() == 0 {
+			return configError(path+".clients", errors.New("missing"))
+		}
+		switch c.Log {
+		case "":
+			g.log = "all"
+		case "all", "errors", "none":
+		default:
+			return configError(path+".log", fmt.Errorf("want all, errors or none, got %q", c.Log))
+		}
+		if c.ECS != "" {
+			ecs, err := ParseECSPolicy(c.ECS)
+			if err != nil {
+				return configError(path+".ecs", err)
+			}
+			g.ecs = &ecs
+		}
+		if len(c.Mapping) > 0 {
+			var defaultRoute []Upstream
+			if refs := c.Mapping[""]; len(refs) > 0 {
+				var err error
+				if defaultRoute, err = s.resolveRefs(path+`.mapping[""]`, refs, named, defaultUpstream); err != nil {
+					return err
+				}
+			}
+			g.routes = newRouteTable(defaultRoute)
+			if err := s.addMapping(path+".mapping", g.routes, c.Mapping, named, defaultUpstream); err != nil {
+				return err
+			}
+		}
+		if len(c.Blocklist) > 0 {
+			g.blocklist = newRouteTable(nil)
+			for i, key := range c.Blocklist {
+				if err := g.blocklist.Add(key, []Upstream{}); err != nil {
+					return configError(fmt.Sprintf("%s.blocklist[%d]", path, i), err)
+				}
+			}
+		}
+		if c.Blocklists != nil {
+			g.ownBlocklists = true
+			for i, name := range c.Blocklists {
+				var found *Blocklist
+				for _, b := range s.blocklists {
+					if b.Name == name {
+						found = b
+					}
+				}
+				if found == nil {
+					return configError(fmt.Sprintf("%s.blocklists[%d]", path, i), fmt.Errorf("unknown blocklist %q", name))
+				}
+				g.blocklists = append(g.blocklists, found)
+			}
+		}
+		if g.routes != nil || g.ecs != nil {
+			if og := old.clientGroupNamed(name); og != nil && og.cache != nil && old.cacheSize == s.cacheSize {
+				g.cache = og.cache
+			} else {
+				g.cache = NewDNSCache(s.cacheSize)
+			}
+		}
+		s.clientGroups = append(s.clientGroups, g)
+	}
+	return nil
+}
+
+func (s *HandlerState) clientGroupNamed(name string) *clientGroup {
+	if s == nil {
+		return nil
+	}
+	for _, g := range s.clientGroups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// clientGroup returns the group addr belongs to, or nil.
+func (s *HandlerState) clientGroup(addr net.Addr) *clientGroup {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	var best *clientGroup
+	bestBits := -1
+	for _, g := range s.clientGroups {
+		if bits, ok := g.clients.Match(ip); ok && bits > bestBits {
+			best, bestBits = g, bits
+		}
+	}
+	return best
+}
+
+// cacheFor returns the cache for queries from g, which may be nil.
+func (s *HandlerState) cacheFor(g *clientGroup) *DNSCache {
+	if g != nil && g.cache != nil {
+		return g.cache
+	}
+	return s.cache
+}
+
+// purgeCaches empties the shared cache and those of client groups.
+func (s *HandlerState) purgeCaches() {
+	s.cache.Purge()
+	for _, g := range s.clientGroups {
+		if g.cache != nil {
+			g.cache.Purge()
+		}
+	}
+}
+
+// blocked returns the blocklist rule matching name, or "".
+func (g *clientGroup) blocked(name string) string {
+	if g == nil || g.blocklist == nil {
+		return ""
+	}
+	route, upstreams := g.blocklist.Lookup(normalizeDomain(name))
+	if upstreams == nil {
+		return ""
+	}
+	return route
+}
+
+// blockedBy returns the blocklist rule of g or the name of the blocklist that
+// blocks name for clients in g, which may be nil, or "".
+func (s *HandlerState) blockedBy(name string, g *clientGroup) string {
+	if rule := g.blocked(name); rule != "" {
+		return rule
+	}
+	if g != nil && g.ownBlocklists {
+		return blockedBy(g.blocklists, name)
+	}
+	return blockedBy(s.blocklists, name)
+}
+
+func (g *clientGroup) shouldLog(rec *QueryLogRecord) bool {
+	if g == nil {
+		return true
+	}
+	switch g.log {
+	case "none":
+		return false
+	case "errors":
+		return rec.Error != "" || rec.Rcode == "SERVFAIL" || rec.Rcode == "NONE"
+	}
+	return true
+}
+
+// addrIP returns the IP of a udp or tcp address, and nil for others.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
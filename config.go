@@ -2,17 +2,287 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type Config struct {
-	Listen          string            `json:"listen"`
-	Proxy           string            `json:"proxy"`
-	MyIP            string            `json:"myip"`
-	Mapping         map[string]string `json:"mapping"`
-	CacheSize       *uint32           `json:"cache_size"`
-	QueryTimeoutSec uint32            `json:"query_timeout_sec"`
+	Listen          string                        `json:"listen"`
+	Proxy           ProxySpec                     `json:"proxy"`
+	Proxies         map[string]ProxySpec          `json:"proxies"`
+	MyIP            string                        `json:"myip"`
+	Upstreams       map[string]*UpstreamConfig    `json:"upstreams"`
+	Mapping         map[string]UpstreamRefs       `json:"mapping"`
+	CacheSize       *uint32                       `json:"cache_size"`
+	QueryTimeoutSec uint32                        `json:"query_timeout_sec"`
+	HttpListen      string                        `json:"http_listen"`
+	QueryLog        []QueryLogConfig              `json:"query_log"`
+	AntiPoison      *AntiPoisonConfig             `json:"anti_poison"`
+	ChinaDNS        *ChinaDNSConfig               `json:"chinadns"`
+	DomainLists     []DomainListConfig            `json:"domain_lists"`
+	ClientGroups    map[string]*ClientGroupConfig `json:"client_groups"`
+	// TypeMapping holds a mapping per query type, such as "PTR".
+	TypeMapping map[string]map[string]UpstreamRefs `json:"type_mapping"`
+	// TypeActions answers query types locally, see typeActionReply.
+	TypeActions   map[string]string           `json:"type_actions"`
+	Local         *LocalConfig                `json:"local"`
+	Blocklists    map[string]*BlocklistConfig `json:"blocklists"`
+	BlockResponse string                      `json:"block_response"`
+	RPZ           []RPZConfig                 `json:"rpz"`
+	Rebinding     *RebindingConfig            `json:"rebinding"`
+	DNS64         *DNS64Config                `json:"dns64"`
+	DNSSEC        *DNSSECConfig               `json:"dnssec"`
+	ECSPrefixV4   *uint8                      `json:"ecs_prefix_v4"`
+	ECSPrefixV6   *uint8                      `json:"ecs_prefix_v6"`
+	// ECSClients maps client IPs or CIDRs to the subnet sent for them.
+	ECSClients map[string]string `json:"ecs_clients"`
+}
+
+// UpstreamConfig describes a named upstream, see README for the fields.
+type UpstreamConfig struct {
+	Type          string            `json:"type"`
+	Address       string            `json:"address"`
+	Proxy         string            `json:"proxy"`
+	TimeoutMs     uint32            `json:"timeout_ms"`
+	ECS           string            `json:"ecs"`
+	TLS           *TLSConfig        `json:"tls"`
+	PoolSize      *int              `json:"pool_size"`
+	IdleTimeoutMs uint32            `json:"idle_timeout_ms"`
+	AntiPoison    *AntiPoisonConfig `json:"anti_poison"`
+}
+
+// AntiPoisonConfig enables AntiPoison on udp upstreams.
+type AntiPoisonConfig struct {
+	WindowMs       uint32   `json:"window_ms"`
+	BogusIPs       []string `json:"bogus_ips"`
+	Use0x20        bool     `json:"use_0x20"`
+	Cookies        bool     `json:"cookies"`
+	KeepSuspicious bool     `json:"keep_suspicious"`
+	CheckIPTTL     bool     `json:"check_ip_ttl"`
+}
+
+// ChinaDNSConfig turns the default route into a ChinaDNSUpstream.
+type ChinaDNSConfig struct {
+	Domestic UpstreamRefs `json:"domestic"`
+	Trusted  UpstreamRefs `json:"trusted"`
+	CNIPFile string       `json:"cn_ip_file"`
+	CNIPs    []string     `json:"cn_ips"`
+}
+
+// DomainListConfig routes the domains listed in a file, see readDomainList.
+type DomainListConfig struct {
+	Path     string       `json:"path"`
+	Format   string       `json:"format"`
+	Upstream UpstreamRefs `json:"upstream"`
+}
+
+// ClientGroupConfig applies to queries from Clients, a list of IPs or CIDRs.
+type ClientGroupConfig struct {
+	Clients    []string                `json:"clients"`
+	Mapping    map[string]UpstreamRefs `json:"mapping"`
+	ECS        string                  `json:"ecs"`
+	Blocklist  []string                `json:"blocklist"`
+	Blocklists []string                `json:"blocklists"`
+	Log        string                  `json:"log"`
+}
+
+// LocalConfig describes names answered locally, see LocalZone.
+type LocalConfig struct {
+	Records    []string `json:"records"`
+	HostsFiles []string `json:"hosts_files"`
+	ZoneFiles  []string `json:"zone_files"`
+	Zones      []string `json:"zones"`
+	TTL        uint32   `json:"ttl"`
+}
+
+// BlocklistConfig is a list of names to block, see Blocklist.
+type BlocklistConfig struct {
+	URL        string `json:"url"`
+	Format     string `json:"format"`
+	Proxy      string `json:"proxy"`
+	RefreshMin uint32 `json:"refresh_min"`
+}
+
+// RPZConfig loads a response policy zone from File or by AXFR from Server.
+type RPZConfig struct {
+	Zone       string `json:"zone"`
+	File       string `json:"file"`
+	Server     string `json:"server"`
+	RefreshMin uint32 `json:"refresh_min"`
+}
+
+// RebindingConfig filters private addresses out of upstream answers.
+type RebindingConfig struct {
+	Action string   `json:"action"`
+	Allow  []string `json:"allow"`
+	Nets   []string `json:"nets"`
+}
+
+// DNS64Config synthesizes AAAA records for names with only A records.
+type DNS64Config struct {
+	Prefix  string   `json:"prefix"`
+	Exclude []string `json:"exclude"`
+	Clients []string `json:"clients"`
+}
+
+// DNSSECConfig turns on validation of upstream answers.
+type DNSSECConfig struct {
+	TrustAnchors []string `json:"trust_anchors"`
+	Insecure     []string `json:"insecure"`
+}
+
+type TLSConfig struct {
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+}
+
+// UpstreamRefs is a mapping value, a comma-separated string or a list.
+type UpstreamRefs []string
+
+func (r *UpstreamRefs) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return errors.New("must be a string or a list of strings")
+		}
+		list = strings.Split(s, ",")
+	}
+	*r = nil
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != "" {
+			*r = append(*r, v)
+		}
+	}
+	return nil
+}
+
+// ProxySpec is a failover list of proxy chains, each a list of URLs.
+type ProxySpec [][]string
+
+func (p *ProxySpec) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*p = nil
+		if s != "" {
+			*p = ProxySpec{{s}}
+		}
+		return nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("must be an url or a list")
+	}
+	*p = nil
+	for i, item := range list {
+		var chain []string
+		if err := json.Unmarshal(item, &s); err == nil {
+			chain = []string{s}
+		} else if err := json.Unmarshal(item, &chain); err != nil {
+			return &elemError{fmt.Sprintf("[%d]", i), errors.New("must be an url or a list of urls")}
+		}
+		if len(chain) == 0 {
+			return &elemError{fmt.Sprintf("[%d]", i), errors.New("is empty")}
+		}
+		*p = append(*p, chain)
+	}
+	return nil
+}
+
+// elemError is an error in an element of a config value, returned by
+// UnmarshalJSON so that the element's index ends up in the error's path.
+type elemError struct {
+	index string
+	err   error
+}
+
+func (e *elemError) Error() string {
+	return e.index + ": " + e.err.Error()
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonErrorPath returns the path of the innermost value of b that fails to
+// decode into t, and its error, or "" and nil if b decodes. encoding/json
+// does not say where an UnmarshalJSON method failed, so the failing value is
+// looked for by decoding the fields, map entries and elements one by one.
+func jsonErrorPath(b []byte, t reflect.Type, path string) (string, error) {
+	err := json.Unmarshal(b, reflect.New(t).Interface())
+	if err == nil {
+		return "", nil
+	}
+	if !reflect.PtrTo(t).Implements(unmarshalerType) {
+		switch t.Kind() {
+		case reflect.Ptr:
+			return jsonErrorPath(b, t.Elem(), path)
+		case reflect.Struct:
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(b, &fields) != nil {
+				break
+			}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				name := strings.Split(f.Tag.Get("json"), ",")[0]
+				raw, ok := fields[name]
+				if name == "" || !ok {
+					continue
+				}
+				fieldPath := name
+				if path != "" {
+					fieldPath = path + "." + name
+				}
+				if p, err := jsonErrorPath(raw, f.Type, fieldPath); err != nil {
+					return p, err
+				}
+			}
+		case reflect.Map:
+			var entries map[string]json.RawMessage
+			if t.Key().Kind() != reflect.String || json.Unmarshal(b, &entries) != nil {
+				break
+			}
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if p, err := jsonErrorPath(entries[k], t.Elem(), fmt.Sprintf("%s[%q]", path, k)); err != nil {
+					return p, err
+				}
+			}
+		case reflect.Slice:
+			var elems []json.RawMessage
+			if json.Unmarshal(b, &elems) != nil {
+				break
+			}
+			for i, elem := range elems {
+				if p, err := jsonErrorPath(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return p, err
+				}
+			}
+		}
+	}
+	if e, ok := err.(*elemError); ok {
+		return path + e.index, e.err
+	}
+	return path, err
+}
+
+type QueryLogConfig struct {
+	Type       string `json:"type"`
+	Path       string `json:"path"`
+	MaxSizeMB  uint32 `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+	Network    string `json:"network"`
+	Address    string `json:"address"`
+	Tag        string `json:"tag"`
+	Size       int    `json:"size"`
 }
 
 func GetConfigFromFile(path string) (*Config, error) {
@@ -20,12 +290,16 @@ func GetConfigFromFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	jsonBytes, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
 	var config Config
 	if err := json.Unmarshal(jsonBytes, &config); err != nil {
+		if path, pathErr := jsonErrorPath(jsonBytes, reflect.TypeOf(config), ""); path != "" {
+			return nil, configError(path, pathErr)
+		}
 		return nil, err
 	}
 	return &config, nil
@@ -1,51 +1,324 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/net/proxy"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/net/proxy"
 )
 
-func NewDialFromURL(u *url.URL) (func(network, addr string) (net.Conn, error), error) {
+// NewDialFromURL returns a dial function going through the proxy in u. The
+// proxy itself is reached with forward, or directly if forward is nil. If
+// release is not nil, it frees what the dial function holds, such as an ss
+// plugin process, once the dial function is no longer used.
+func NewDialFromURL(u *url.URL, forward func(network, addr string) (net.Conn, error)) (dial func(network, addr string) (net.Conn, error), release func(), err error) {
+	if u.Scheme == "ss" && forward != nil && u.Query().Get("plugin") != "" {
+		return nil, nil, errors.New("ss with plugin cannot be reached through another proxy")
+	}
+	if forward == nil {
+		forward = (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).Dial
+	}
 	switch u.Scheme {
 	case "ss":
-		return newSSDial(u)
+		return newSSDial(u, forward)
 	case "socks5":
-		dialer, err := proxy.FromURL(u, proxy.Direct)
-		return dialer.Dial, err
+		dialer, err := proxy.FromURL(u, forwardDialer(forward))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dialer.Dial, nil, nil
+	case "http", "https":
+		dial, err = newHTTPConnectDial(u, forward, nil)
+		return dial, nil, err
 	default:
-		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+		return nil, nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 	}
 }
 
-func newSSDial(u *url.URL) (func(network, addr string) (net.Conn, error), error) {
-	password, ok := u.User.Password()
-	if !ok {
-		return nil, errors.New("no password")
+// newSSDial accepts the legacy ss://method:password@host:port form, SIP002
+// ss://base64url(method:password)@host:port/?plugin=... and the older
+// ss://base64(method:password@host:port). AEAD ciphers are handled by
+// go-shadowsocks2, stream ciphers by shadowsocks-go. The dummy cipher is
+// refused, as it would send queries in the clear.
+func newSSDial(u *url.URL, forward func(network, addr string) (net.Conn, error)) (dial func(network, addr string) (net.Conn, error), release func(), err error) {
+	method, password, server, err := parseSSURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.EqualFold(method, "dummy") {
+		return nil, nil, errors.New("cipher dummy does not encrypt")
 	}
-	if _, err := ss.NewCipher(u.User.Username(), password); err != nil {
-		return nil, err
+	aead, aeadErr := sscore.PickCipher(method, nil, password)
+	if aeadErr != nil {
+		if _, err := ss.NewCipher(method, password); err != nil {
+			return nil, nil, err
+		}
+	}
+	serverAddr := func() (string, error) { return server, nil }
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		if serverAddr, release, err = startSSPlugin(plugin, server); err != nil {
+			return nil, nil, fmt.Errorf("plugin: %v", err)
+		}
+	}
+	if aeadErr == nil {
+		return func(network, addr string) (net.Conn, error) {
+			target := socks.ParseAddr(addr)
+			if target == nil {
+				return nil, fmt.Errorf("invalid address %s", addr)
+			}
+			server, err := serverAddr()
+			if err != nil {
+				return nil, err
+			}
+			conn, err := forward("tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			c := aead.StreamConn(conn)
+			if _, err = c.Write(target); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}, release, nil
 	}
 	return func(network, addr string) (net.Conn, error) {
 		rawAddr, err := ss.RawAddr(addr)
 		if err != nil {
 			return nil, err
 		}
-		conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+		server, err := serverAddr()
 		if err != nil {
 			return nil, err
 		}
-		cipher, _ := ss.NewCipher(u.User.Username(), password)
+		conn, err := forward("tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		cipher, _ := ss.NewCipher(method, password)
 		c := ss.NewConn(conn, cipher)
 		if _, err = c.Write(rawAddr); err != nil {
 			c.Close()
 			return nil, err
 		}
 		return c, nil
+	}, release, nil
+}
+
+func parseSSURL(u *url.URL) (method, password, server string, err error) {
+	server = u.Host
+	var userinfo string
+	switch {
+	case u.User == nil:
+		// ss://base64(method:password@host:port)
+		b, err := decodeBase64(u.Host)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid ss url: %v", err)
+		}
+		idx := strings.LastIndexByte(string(b), '@')
+		if idx < 0 {
+			return "", "", "", errors.New("invalid ss url: no server")
+		}
+		userinfo, server = string(b[:idx]), string(b[idx+1:])
+	default:
+		if p, ok := u.User.Password(); ok {
+			return u.User.Username(), p, server, nil
+		}
+		b, err := decodeBase64(u.User.Username())
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid ss userinfo: %v", err)
+		}
+		userinfo = string(b)
+	}
+	parts := strings.SplitN(userinfo, ":", 2)
+	if len(parts) != 2 {
+		return "", "", "", errors.New("no password")
+	}
+	return parts[0], parts[1], server, nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// newHTTPConnectDial tunnels through an HTTP proxy with CONNECT. Credentials
+// come from the URL userinfo, and each "header" query parameter in the form
+// "Name: value" is sent along with the request. For https the connection to
+// the proxy itself is TLS, using tlsConfig if not nil.
+func newHTTPConnectDial(u *url.URL, forward func(network, addr string) (net.Conn, error), tlsConfig *tls.Config) (func(network, addr string) (net.Conn, error), error) {
+	header := make(http.Header)
+	for _, h := range u.Query()["header"] {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q", h)
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := forward("tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if u.Scheme == "https" {
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: header,
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+		}
+		conn.SetDeadline(time.Time{})
+		if br.Buffered() > 0 {
+			return &bufferedConn{conn, br}, nil
+		}
+		return conn, nil
 	}, nil
 }
+
+// bufferedConn returns bytes the proxy sent right after its response before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ProxyDisplayName returns u without credentials, for logging.
+func ProxyDisplayName(u *url.URL) string {
+	if u.Scheme == "ss" && u.User == nil {
+		// The whole ss://base64(method:password@host:port) is secret.
+		return "ss://..."
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// forwardDialer adapts a dial function to proxy.Dialer.
+type forwardDialer func(network, addr string) (net.Conn, error)
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+const (
+	proxyMinBackoff = 5 * time.Second
+	proxyMaxBackoff = 5 * time.Minute
+)
+
+// FailoverDial tries each dial function in order. One that fails is marked
+// down and skipped for a backoff period, doubling on each consecutive failure.
+// When every one is down, all are tried anyway.
+type FailoverDial struct {
+	Dials []func(network, addr string) (net.Conn, error)
+	Names []string
+
+	sync.Mutex
+	downUntil []time.Time
+	backoff   []time.Duration
+}
+
+func NewFailoverDial(names []string, dials []func(network, addr string) (net.Conn, error)) *FailoverDial {
+	return &FailoverDial{
+		Dials:     dials,
+		Names:     names,
+		downUntil: make([]time.Time, len(dials)),
+		backoff:   make([]time.Duration, len(dials)),
+	}
+}
+
+func (f *FailoverDial) Dial(network, addr string) (net.Conn, error) {
+	now := time.Now()
+	f.Lock()
+	var up, down []int
+	for i := range f.Dials {
+		if now.Before(f.downUntil[i]) {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	f.Unlock()
+	var errs []string
+	for _, i := range append(up, down...) {
+		conn, err := f.Dials[i](network, addr)
+		f.Lock()
+		if err == nil {
+			f.downUntil[i], f.backoff[i] = time.Time{}, 0
+			f.Unlock()
+			return conn, nil
+		}
+		if f.backoff[i] == 0 {
+			f.backoff[i] = proxyMinBackoff
+		} else if f.backoff[i] *= 2; f.backoff[i] > proxyMaxBackoff {
+			f.backoff[i] = proxyMaxBackoff
+		}
+		f.downUntil[i] = time.Now().Add(f.backoff[i])
+		log.Printf("proxy %s failed, marked down for %v: %v", f.Names[i], f.backoff[i], err)
+		f.Unlock()
+		errs = append(errs, fmt.Sprintf("%s: %v", f.Names[i], err))
+	}
+	return nil, fmt.Errorf("all proxies failed: %s", strings.Join(errs, "; "))
+}
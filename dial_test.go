@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy answers CONNECT requests carrying the wanted headers by
+// echoing what the client sends through the tunnel, and others with 407.
+func connectProxy(t *testing.T, want http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "want CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		for k := range want {
+			if got := r.Header.Get(k); got != want.Get(k) {
+				t.Logf("%s: got %q, want %q", k, got, want.Get(k))
+				http.Error(w, "bad "+k, http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		if r.Host != "dns.example:853" {
+			t.Errorf("CONNECT to %q, want dns.example:853", r.Host)
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	})
+}
+
+func directDial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, time.Second)
+}
+
+// checkTunnel dials through the proxy and checks that bytes come back.
+func checkTunnel(t *testing.T, dial func(network, addr string) (net.Conn, error)) {
+	t.Helper()
+	conn, err := dial("tcp", "dns.example:853")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("read %q, %v, want ping", line, err)
+	}
+}
+
+func TestHTTPConnectDial(t *testing.T) {
+	want := http.Header{}
+	want.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:p@ss")))
+	want.Set("X-Token", "abc: def")
+	srv := httptest.NewServer(connectProxy(t, want))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("user", "p@ss")
+	u.RawQuery = url.Values{"header": {"X-Token: abc: def"}}.Encode()
+	dial, err := newHTTPConnectDial(u, directDial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTunnel(t, dial)
+}
+
+func TestHTTPConnectDialRefused(t *testing.T) {
+	want := http.Header{}
+	want.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")))
+	srv := httptest.NewServer(connectProxy(t, want))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("user", "wrong")
+	dial, err := newHTTPConnectDial(u, directDial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial("tcp", "dns.example:853")
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Errorf("error %q does not mention the status", err)
+	}
+}
+
+func TestHTTPConnectDialTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(connectProxy(t, nil))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	if u.Scheme != "https" {
+		t.Fatalf("proxy url %s is not https", u)
+	}
+	tlsConfig := &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	dial, err := newHTTPConnectDial(u, directDial, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTunnel(t, dial)
+
+	// Without the test CA the proxy's certificate is not trusted.
+	dial, _ = newHTTPConnectDial(u, directDial, nil)
+	if conn, err := dial("tcp", "dns.example:853"); err == nil {
+		conn.Close()
+		t.Error("dial with an untrusted certificate succeeded")
+	}
+}
+
+func TestHTTPConnectDialBadHeader(t *testing.T) {
+	u, _ := url.Parse("http://proxy.example:3128/?header=novalue")
+	if _, err := newHTTPConnectDial(u, directDial, nil); err == nil {
+		t.Error("invalid header accepted")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// defaultDNS64Exclude are IPv4 ranges that are not reachable through a NAT64
+// gateway; RFC 6052 forbids the well-known prefix for private addresses.
+var defaultDNS64Exclude = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+}
+
+// DNS64 synthesizes AAAA records from A records for names that have none, as
+// described in RFC 6147.
+type DNS64 struct {
+	prefix *net.IPNet
+	// exclude holds IPv4 addresses not to synthesize from, and IPv6 addresses
+	// that do not count as AAAA answers.
+	exclude *IPSet
+	// clients is nil if DNS64 applies to every client.
+	clients *IPSet
+}
+
+func NewDNS64(path string, c *DNS64Config) (*DNS64, error) {
+	d := &DNS64{exclude: NewIPSet()}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "64:ff9b::/96"
+	}
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil || n.IP.To4() != nil {
+		return nil, configError(path+".prefix", fmt.Errorf("want an IPv6 prefix, got %q", prefix))
+	}
+	switch ones, _ := n.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, configError(path+".prefix", errors.New("length must be 32, 40, 48, 56, 64 or 96"))
+	}
+	if n.IP[8] != 0 {
+		return nil, configError(path+".prefix", errors.New("bits 64 to 71 must be zero"))
+	}
+	d.prefix = n
+	exclude := c.Exclude
+	if exclude == nil {
+		exclude = defaultDNS64Exclude
+	}
+	if err := d.exclude.AddStrings(path+".exclude", exclude); err != nil {
+		return nil, err
+	}
+	if len(c.Clients) > 0 {
+		d.clients = NewIPSet()
+		if err := d.clients.AddStrings(path+".clients", c.Clients); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// wants reports whether the AAAA answer r to q, nil if no upstream answered,
+// should be replaced by synthesized records.
+func (d *DNS64) wants(client net.Addr, q dns.Question, r *dns.Msg) bool {
+	if d == nil || q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET {
+		return false
+	}
+	if d.clients != nil {
+		if !d.clients.Contains(addrIP(client)) {
+			return false
+		}
+	}
+	if r == nil {
+		return true
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return false
+	}
+	for _, rr := range r.Answer {
+		// IPv4-mapped addresses never count as AAAA answers.
+		if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil && !d.exclude.Contains(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize answers question qi of req with AAAA records made from the A
+// records in a, or returns nil if there are none to use. r is the AAAA answer,
+// whose negative caching TTL limits that of the synthesized records.
+func (d *DNS64) synthesize(req *dns.Msg, qi int, r, a *dns.Msg) *dns.Msg {
+	if a.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	maxTTL := uint32(600)
+	if r != nil {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				maxTTL = soa.Hdr.Ttl
+				if soa.Minttl < maxTTL {
+					maxTTL = soa.Minttl
+				}
+			}
+		}
+	}
+	m := localReply(req, qi, dns.RcodeSuccess)
+	found := false
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		case *dns.A:
+			ip4 := rr.A.To4()
+			if ip4 == nil || d.exclude.Contains(ip4) {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: d.embed(ip4)})
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return m
+}
+
+// embed returns ip4 under the prefix, laid out as in RFC 6052 section 2.2.
+func (d *DNS64) embed(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	ones, _ := d.prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootTrustAnchors are the root zone KSKs published by IANA, KSK-2017 and
+// KSK-2024.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// maxNSEC3Iterations follows RFC 9276: proofs using more iterations are
+	// treated as insecure rather than spending the CPU to check them.
+	maxNSEC3Iterations = 150
+	// Validated keys are cached for their TTL, at most maxKeyTTL; failures
+	// and insecure delegations are cached for negativeKeyTTL.
+	maxKeyTTL      = time.Hour
+	negativeKeyTTL = time.Minute
+)
+
+type dnssecState int
+
+const (
+	dnssecSecure dnssecState = iota
+	dnssecInsecure
+	dnssecBogus
+	// dnssecNoZone marks a name that is not a zone cut.
+	dnssecNoZone
+)
+
+func (s dnssecState) String() string {
+	switch s {
+	case dnssecSecure:
+		return "secure"
+	case dnssecInsecure:
+		return "insecure"
+	case dnssecBogus:
+		return "bogus"
+	}
+	return "nozone"
+}
+
+// dnssecResult is the outcome of a validation. For bogus results, ede is the
+// RFC 8914 extended error code and reason says what failed.
+type dnssecResult struct {
+	state  dnssecState
+	ede    uint16
+	reason string
+}
+
+func bogus(ede uint16, format string, args ...interface{}) dnssecResult {
+	return dnssecResult{state: dnssecBogus, ede: ede, reason: fmt.Sprintf(format, args...)}
+}
+
+// worse combines the results for parts of an answer: any bogus part makes it
+// bogus, and any insecure part makes it insecure.
+func (r dnssecResult) worse(o dnssecResult) dnssecResult {
+	if o.state > r.state {
+		return o
+	}
+	return r
+}
+
+// zoneKeys is the validated DNSKEY set of a zone, or why there is none.
+type zoneKeys struct {
+	dnssecResult
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// Validator checks upstream answers against the chain of trust from the
+// trust anchors, fetching DS and DNSKEY records through lookup, which must
+// ask with the DO and CD bits set.
+type Validator struct {
+	anchors  map[string][]*dns.DS
+	insecure *routeTable
+	lookup   func(name string, qtype uint16) *dns.Msg
+
+	sync.Mutex
+	zones map[string]*zoneKeys
+}
+
+func NewValidator(path string, c *DNSSECConfig, config *Config, lookup func(string, uint16) *dns.Msg) (*Validator, error) {
+	v := &Validator{
+		anchors: make(map[string][]*dns.DS),
+		lookup:  lookup,
+		zones:   make(map[string]*zoneKeys),
+	}
+	anchors := c.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootTrustAnchors
+	}
+	for i, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err == nil && rr == nil {
+			err = errors.New("empty")
+		}
+		if err != nil {
+			return nil, configError(fmt.Sprintf("%s.trust_anchors[%d]", path, i), err)
+		}
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		default:
+			return nil, configError(fmt.Sprintf("%s.trust_anchors[%d]", path, i), errors.New("want a DS or DNSKEY record"))
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	var err error
+	if v.insecure, err = newNameSet(path+".insecure", c.Insecure, config); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// setDNSSECOK asks an upstream for signatures, and for answers it has not
+// validated itself.
+func setDNSSECOK(m *dns.Msg) {
+	m.CheckingDisabled = true
+	if o := m.IsEdns0(); o != nil {
+		o.SetDo()
+		return
+	}
+	m.SetEdns0(DefaultUDPSize, true)
+}
+
+// Apply validates r, the upstream answer to question qi of req, and returns
+// the reply to send: r with AD set if it is secure and the client asked for
+// it, or SERVFAIL with an extended error if it is bogus. Clients that set CD
+// get r as it is. Signatures are left out for clients that did not set DO.
+func (v *Validator) Apply(req *dns.Msg, qi int, r *dns.Msg) (reply *dns.Msg, state string) {
+	if v == nil || r == nil {
+		return r, ""
+	}
+	do := false
+	if o := req.IsEdns0(); o != nil {
+		do = o.Do()
+	}
+	var res dnssecResult
+	if !req.CheckingDisabled {
+		res = v.Validate(req.Question[qi], r)
+		state = res.state.String()
+		metricDNSSECResults.WithLabelValues(state).Inc()
+	}
+	if res.state == dnssecBogus {
+		q := req.Question[qi]
+		log.Printf("dnssec: %s %s is bogus: %s", q.Name, dns.TypeToString[q.Qtype], res.reason)
+		reply = localReply(req, qi, dns.RcodeServerFailure)
+		if req.IsEdns0() != nil {
+			reply.SetEdns0(DefaultUDPSize, do)
+			o := reply.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_EDE{InfoCode: res.ede, ExtraText: res.reason})
+		}
+		return reply, state
+	}
+	reply = r.Copy()
+	reply.AuthenticatedData = !req.CheckingDisabled && res.state == dnssecSecure && (do || req.AuthenticatedData)
+	reply.CheckingDisabled = req.CheckingDisabled
+	if !do {
+		qtype := req.Question[qi].Qtype
+		reply.Answer = stripDNSSEC(reply.Answer, qtype)
+		reply.Ns = stripDNSSEC(reply.Ns, qtype)
+		if o := reply.IsEdns0(); o != nil {
+			o.SetDo(false)
+		}
+	}
+	return reply, state
+}
+
+// Bogus reports whether r, the answer to q, fails validation.
+func (v *Validator) Bogus(q dns.Question, r *dns.Msg) bool {
+	return v != nil && v.Validate(q, r).state == dnssecBogus
+}
+
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Validate checks every RRset in the answer section of r, and the proof that
+// the name or type does not exist if r has no answer to q.
+func (v *Validator) Validate(q dns.Question, r *dns.Msg) dnssecResult {
+	name := strings.ToLower(q.Name)
+	if q.Qclass != dns.ClassINET || v.insecure.containsName(name) {
+		return dnssecResult{state: dnssecInsecure}
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return dnssecResult{state: dnssecInsecure}
+	}
+	sets, sigs := rrsets(r.Answer)
+	res := dnssecResult{state: dnssecSecure}
+	for _, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeCNAME && len(sigs[rrsetKey(set[0])]) == 0 && synthesizedCNAME(set[0].Header().Name, sets) {
+			continue
+		}
+		res = res.worse(v.validateRRset(set, sigs[rrsetKey(set[0])], r.Ns))
+	}
+
+	// Follow CNAMEs to the name the question is really about.
+	answered := q.Qtype == dns.TypeANY
+	for hops := 0; hops < maxCNAMEChain && !answered; hops++ {
+		next := ""
+		for _, rr := range r.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == q.Qtype {
+				answered = true
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(cname.Target)
+			}
+		}
+		if answered || next == "" {
+			break
+		}
+		name = next
+	}
+	if !answered {
+		res = res.worse(v.validateDenial(name, q.Qtype, r))
+	}
+	return res
+}
+
+// synthesizedCNAME reports whether sets has a DNAME the CNAME at name may
+// have been made from. Such CNAMEs are unsigned, the DNAME being validated
+// instead.
+func synthesizedCNAME(name string, sets [][]dns.RR) bool {
+	for _, set := range sets {
+		if h := set[0].Header(); h.Rrtype == dns.TypeDNAME && dns.IsSubDomain(h.Name, name) && !strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func rrsetKey(rr dns.RR) string {
+	h := rr.Header()
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		return strings.ToLower(h.Name) + "/" + dns.TypeToString[sig.TypeCovered]
+	}
+	return strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+}
+
+// rrsets groups rrs into RRsets, and their signatures by RRset.
+func rrsets(rrs []dns.RR) (sets [][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	sigs = make(map[string][]*dns.RRSIG)
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		key := rrsetKey(rr)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return
+}
+
+// validateRRset checks set against sigs. An unsigned set is only accepted in
+// an insecure zone. ns is the authority section, which proves that a
+// wildcard was expanded only for a name that does not exist.
+func (v *Validator) validateRRset(set []dns.RR, sigs []*dns.RRSIG, ns []dns.RR) dnssecResult {
+	owner := strings.ToLower(set[0].Header().Name)
+	if len(sigs) == 0 {
+		if _, zk := v.zoneOf(owner); zk.state != dnssecSecure {
+			return zk.dnssecResult
+		}
+		return bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no signature for %s %s", owner, dns.TypeToString[set[0].Header().Rrtype])
+	}
+	signer := strings.ToLower(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, owner) {
+		return bogus(dns.ExtendedErrorCodeDNSBogus, "%s signed by %s", owner, signer)
+	}
+	zone, zk := v.zoneOf(signer)
+	if zk.state != dnssecSecure {
+		return zk.dnssecResult
+	}
+	if zone != signer {
+		return bogus(dns.ExtendedErrorCodeDNSKEYMissing, "%s is not a signed zone", signer)
+	}
+	sig, res := verifyRRset(set, sigs, zk.keys)
+	if res.state != dnssecSecure {
+		return res
+	}
+	if labels := dns.CountLabel(owner); int(sig.Labels) < labels {
+		// The answer was expanded from a wildcard; the name itself must not
+		// exist.
+		closest := strings.Join(dns.SplitDomainName(owner)[labels-int(sig.Labels):], ".") + "."
+		proofs, res := v.denialRecords(ns, zone, zk.keys)
+		if res.state != dnssecSecure {
+			return res
+		}
+		if !proofs.coversName(owner, closest) {
+			return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s does not exist", owner)
+		}
+	}
+	return res
+}
+
+// verifyRRset returns the signature in sigs made by one of keys that is valid
+// for set.
+func verifyRRset(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) (*dns.RRSIG, dnssecResult) {
+	res := bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no key for the signatures of %s %s", set[0].Header().Name, dns.TypeToString[set[0].Header().Rrtype])
+	now := time.Now()
+	for _, sig := range sigs {
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(k, set); err != nil {
+				res = bogus(dns.ExtendedErrorCodeDNSBogus, "bad signature for %s %s: %v", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], err)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				code := dns.ExtendedErrorCodeSignatureExpired
+				if now.Unix() < int64(sig.Inception) {
+					code = dns.ExtendedErrorCodeSignatureNotYetValid
+				}
+				res = bogus(code, "signature for %s %s not valid now", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+				continue
+			}
+			return sig, dnssecResult{state: dnssecSecure}
+		}
+	}
+	return nil, res
+}
+
+// zoneOf returns the closest enclosing zone of name that the chain of trust
+// reaches, and its keys. It stops at the first insecure or bogus zone.
+func (v *Validator) zoneOf(name string) (string, *zoneKeys) {
+	labels := dns.SplitDomainName(name)
+	zone := "."
+	zk := v.anchored(zone)
+	if zk == nil {
+		return zone, &zoneKeys{dnssecResult: dnssecResult{state: dnssecInsecure}}
+	}
+	for i := len(labels) - 1; i >= 0 && zk.state == dnssecSecure; i-- {
+		child := strings.Join(labels[i:], ".") + "."
+		if v.insecure.containsName(child) {
+			return child, &zoneKeys{dnssecResult: dnssecResult{state: dnssecInsecure}}
+		}
+		ck := v.anchored(child)
+		if ck == nil {
+			ck = v.delegation(zone, zk, child)
+		}
+		if ck.state != dnssecNoZone {
+			zone, zk = child, ck
+		}
+	}
+	return zone, zk
+}
+
+// cached returns the keys of zone if they have not expired.
+func (v *Validator) cached(zone string) *zoneKeys {
+	v.Lock()
+	defer v.Unlock()
+	if zk := v.zones[zone]; zk != nil && time.Now().Before(zk.expires) {
+		return zk
+	}
+	return nil
+}
+
+func (v *Validator) store(zone string, zk *zoneKeys, ttl time.Duration) *zoneKeys {
+	if zk.state != dnssecSecure || ttl > maxKeyTTL {
+		ttl = negativeKeyTTL
+	}
+	zk.expires = time.Now().Add(ttl)
+	v.Lock()
+	v.zones[zone] = zk
+	v.Unlock()
+	return zk
+}
+
+// anchored returns the keys of zone if it has a trust anchor, or nil.
+func (v *Validator) anchored(zone string) *zoneKeys {
+	ds, ok := v.anchors[zone]
+	if !ok {
+		return nil
+	}
+	if zk := v.cached(zone); zk != nil {
+		return zk
+	}
+	return v.fetchKeys(zone, ds, 0)
+}
+
+// delegation follows the chain of trust from zone, whose keys are zk, to
+// child, which may not be a zone cut.
+func (v *Validator) delegation(zone string, zk *zoneKeys, child string) *zoneKeys {
+	if ck := v.cached(child); ck != nil {
+		return ck
+	}
+	r := v.lookup(child, dns.TypeDS)
+	if r == nil {
+		// Not cached, so the next query tries again.
+		return &zoneKeys{dnssecResult: bogus(dns.ExtendedErrorCodeNoReachableAuthority, "no answer for %s DS", child)}
+	}
+	sets, sigs := rrsets(r.Answer)
+	for _, set := range sets {
+		if set[0].Header().Rrtype == dns.TypeCNAME && strings.EqualFold(set[0].Header().Name, child) {
+			// An alias is never a zone cut; the CNAME itself is checked
+			// when it is part of an answer.
+			return v.store(child, &zoneKeys{dnssecResult: dnssecResult{state: dnssecNoZone}}, 0)
+		}
+		if set[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(set[0].Header().Name, child) {
+			continue
+		}
+		if _, res := verifyRRset(set, sigs[rrsetKey(set[0])], zk.keys); res.state != dnssecSecure {
+			return v.store(child, &zoneKeys{dnssecResult: res}, 0)
+		}
+		ds := make([]*dns.DS, len(set))
+		for i, rr := range set {
+			ds[i] = rr.(*dns.DS)
+		}
+		return v.fetchKeys(child, ds, time.Duration(set[0].Header().Ttl)*time.Second)
+	}
+
+	proofs, res := v.denialRecords(r.Ns, zone, zk.keys)
+	if res.state != dnssecSecure {
+		return v.store(child, &zoneKeys{dnssecResult: res}, 0)
+	}
+	state := proofs.delegationState(child)
+	if state == dnssecBogus {
+		return v.store(child, &zoneKeys{dnssecResult: bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no DS", child)}, 0)
+	}
+	return v.store(child, &zoneKeys{dnssecResult: dnssecResult{state: state}}, 0)
+}
+
+// fetchKeys fetches the DNSKEY set of zone and checks it against ds. The
+// result is cached for at most ttl, or the TTL of the set if ttl is 0.
+func (v *Validator) fetchKeys(zone string, ds []*dns.DS, ttl time.Duration) *zoneKeys {
+	supported := ds[:0:0]
+	for _, d := range ds {
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+		default:
+			continue
+		}
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+			supported = append(supported, d)
+		}
+	}
+	if len(supported) == 0 {
+		// RFC 4035 5.2: a zone signed only with unknown algorithms is
+		// treated as unsigned.
+		return v.store(zone, &zoneKeys{dnssecResult: dnssecResult{state: dnssecInsecure}}, 0)
+	}
+	r := v.lookup(zone, dns.TypeDNSKEY)
+	if r == nil {
+		return &zoneKeys{dnssecResult: bogus(dns.ExtendedErrorCodeNoReachableAuthority, "no answer for %s DNSKEY", zone)}
+	}
+	var set []dns.RR
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range r.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			set = append(set, rr)
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	var sep []*dns.DNSKEY
+	for _, k := range keys {
+		for _, d := range supported {
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				sep = append(sep, k)
+				break
+			}
+		}
+	}
+	if len(sep) == 0 {
+		return v.store(zone, &zoneKeys{dnssecResult: bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s matches its DS", zone)}, 0)
+	}
+	if _, res := verifyRRset(set, sigs, sep); res.state != dnssecSecure {
+		return v.store(zone, &zoneKeys{dnssecResult: res}, 0)
+	}
+	if keyTTL := time.Duration(set[0].Header().Ttl) * time.Second; ttl == 0 || keyTTL < ttl {
+		ttl = keyTTL
+	}
+	return v.store(zone, &zoneKeys{dnssecResult: dnssecResult{state: dnssecSecure}, keys: keys}, ttl)
+}
+
+// denialProofs are the validated NSEC or NSEC3 records of an answer.
+type denialProofs struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+	// insecure is set if an NSEC3 record uses more than maxNSEC3Iterations.
+	insecure bool
+}
+
+// denialRecords returns the NSEC and NSEC3 records in ns signed by the keys
+// of zone.
+func (v *Validator) denialRecords(ns []dns.RR, zone string, keys []*dns.DNSKEY) (*denialProofs, dnssecResult) {
+	p := new(denialProofs)
+	sets, sigs := rrsets(ns)
+	for _, set := range sets {
+		t := set[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		setSigs := sigs[rrsetKey(set[0])]
+		if len(setSigs) == 0 || !strings.EqualFold(setSigs[0].SignerName, zone) {
+			continue
+		}
+		if _, res := verifyRRset(set, setSigs, keys); res.state != dnssecSecure {
+			return nil, res
+		}
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				p.nsec = append(p.nsec, rr)
+			case *dns.NSEC3:
+				if rr.Iterations > maxNSEC3Iterations {
+					p.insecure = true
+				}
+				p.nsec3 = append(p.nsec3, rr)
+			}
+		}
+	}
+	if len(p.nsec) == 0 && len(p.nsec3) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeNSECMissing, "no signed NSEC or NSEC3 records from %s", zone)
+	}
+	if p.insecure {
+		return p, dnssecResult{state: dnssecInsecure, ede: dns.ExtendedErrorCodeUnsupportedNSEC3IterValue}
+	}
+	return p, dnssecResult{state: dnssecSecure}
+}
+
+// validateDenial checks that r proves that name has no qtype records, or does
+// not exist if r is NXDOMAIN.
+func (v *Validator) validateDenial(name string, qtype uint16, r *dns.Msg) dnssecResult {
+	zone, zk := v.zoneOf(name)
+	if zk.state != dnssecSecure {
+		return zk.dnssecResult
+	}
+	proofs, res := v.denialRecords(r.Ns, zone, zk.keys)
+	if res.state != dnssecSecure {
+		return res
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return proofs.nameError(name)
+	}
+	return proofs.noData(name, qtype)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// nsecCovers reports whether name falls strictly between the owner of n and
+// the next name, the last NSEC of a zone wrapping around to its apex.
+func nsecCovers(n *dns.NSEC, name string) bool {
+	if canonicalCompare(n.Hdr.Name, name) >= 0 {
+		return false
+	}
+	if canonicalCompare(n.Hdr.Name, n.NextDomain) >= 0 {
+		return dns.IsSubDomain(n.NextDomain, name)
+	}
+	return canonicalCompare(name, n.NextDomain) < 0
+}
+
+// parentName returns name without its first label.
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// wildcardOf returns the wildcard name directly below closest.
+func wildcardOf(closest string) string {
+	if closest == "." {
+		return "*."
+	}
+	return "*." + closest
+}
+
+// nextCloser returns the ancestor of name, or name itself, that is one label
+// below closest.
+func nextCloser(name, closest string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(closest) + 1
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// closestEncloser finds the NSEC3 proving the closest existing ancestor of
+// name, and the one covering the next closer name. covering is nil if name
+// itself exists.
+func (p *denialProofs) closestEncloser(name string) (closest string, match, covering *dns.NSEC3) {
+	for c := name; ; c = parentName(c) {
+		for _, n := range p.nsec3 {
+			if n.Match(c) {
+				match = n
+			}
+		}
+		if match != nil {
+			closest = c
+			break
+		}
+		if c == "." {
+			return "", nil, nil
+		}
+	}
+	if closest == name {
+		return closest, match, nil
+	}
+	next := nextCloser(name, closest)
+	for _, n := range p.nsec3 {
+		if n.Cover(next) {
+			return closest, match, n
+		}
+	}
+	return "", nil, nil
+}
+
+func (p *denialProofs) nsec3Covering(name string) *dns.NSEC3 {
+	for _, n := range p.nsec3 {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p *denialProofs) nsecCovering(name string) *dns.NSEC {
+	for _, n := range p.nsec {
+		if nsecCovers(n, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p *denialProofs) nsecAt(name string) *dns.NSEC {
+	for _, n := range p.nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// coversName reports whether the proofs show that name, which was answered
+// from the wildcard at closest, does not exist.
+func (p *denialProofs) coversName(name, closest string) bool {
+	if p.nsecCovering(name) != nil {
+		return true
+	}
+	return p.nsec3Covering(nextCloser(name, closest)) != nil
+}
+
+// nameError checks the proof for NXDOMAIN: name does not exist, and neither
+// does a wildcard at its closest encloser.
+func (p *denialProofs) nameError(name string) dnssecResult {
+	if n := p.nsecCovering(name); n != nil {
+		labels := dns.CompareDomainName(name, n.Hdr.Name)
+		if l := dns.CompareDomainName(name, n.NextDomain); l > labels {
+			labels = l
+		}
+		closest := "."
+		if labels > 0 {
+			all := dns.SplitDomainName(name)
+			closest = strings.Join(all[len(all)-labels:], ".") + "."
+		}
+		if p.nsecCovering(wildcardOf(closest)) != nil {
+			return dnssecResult{state: dnssecSecure}
+		}
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that *.%s does not exist", strings.TrimSuffix(closest, "."))
+	}
+	closest, _, covering := p.closestEncloser(name)
+	if covering == nil {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s does not exist", name)
+	}
+	if covering.Flags&1 != 0 {
+		// Opt-out: the name may be an unsigned delegation.
+		return dnssecResult{state: dnssecInsecure}
+	}
+	if p.nsec3Covering(wildcardOf(closest)) == nil {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that *.%s does not exist", strings.TrimSuffix(closest, "."))
+	}
+	return dnssecResult{state: dnssecSecure}
+}
+
+// noData checks the proof that name exists without qtype records: directly,
+// as an empty non-terminal, or through a wildcard without them.
+func (p *denialProofs) noData(name string, qtype uint16) dnssecResult {
+	if n := p.nsecAt(name); n != nil {
+		if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+			return bogus(dns.ExtendedErrorCodeDNSBogus, "NSEC shows %s has %s records", name, dns.TypeToString[qtype])
+		}
+		return dnssecResult{state: dnssecSecure}
+	}
+	if n := p.nsecCovering(name); n != nil {
+		if dns.IsSubDomain(name, n.NextDomain) {
+			return dnssecResult{state: dnssecSecure}
+		}
+		labels := dns.CompareDomainName(name, n.Hdr.Name)
+		if l := dns.CompareDomainName(name, n.NextDomain); l > labels {
+			labels = l
+		}
+		closest := "."
+		if labels > 0 {
+			all := dns.SplitDomainName(name)
+			closest = strings.Join(all[len(all)-labels:], ".") + "."
+		}
+		if w := p.nsecAt(wildcardOf(closest)); w != nil && !hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, dns.TypeCNAME) {
+			return dnssecResult{state: dnssecSecure}
+		}
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no %s records", name, dns.TypeToString[qtype])
+	}
+	closest, match, covering := p.closestEncloser(name)
+	switch {
+	case match == nil:
+	case covering == nil:
+		if hasType(match.TypeBitMap, qtype) || hasType(match.TypeBitMap, dns.TypeCNAME) {
+			return bogus(dns.ExtendedErrorCodeDNSBogus, "NSEC3 shows %s has %s records", name, dns.TypeToString[qtype])
+		}
+		return dnssecResult{state: dnssecSecure}
+	case covering.Flags&1 != 0 && qtype == dns.TypeDS:
+		return dnssecResult{state: dnssecInsecure}
+	default:
+		for _, w := range p.nsec3 {
+			if w.Match(wildcardOf(closest)) && !hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, dns.TypeCNAME) {
+				return dnssecResult{state: dnssecSecure}
+			}
+		}
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no %s records", name, dns.TypeToString[qtype])
+}
+
+// delegationState tells from the proofs for a DS query whether child is an
+// unsigned delegation (insecure), not a zone cut, or neither is proven.
+func (p *denialProofs) delegationState(child string) dnssecState {
+	if n := p.nsecAt(child); n != nil {
+		switch {
+		case hasType(n.TypeBitMap, dns.TypeDS):
+			return dnssecBogus
+		case hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA):
+			return dnssecInsecure
+		}
+		return dnssecNoZone
+	}
+	if p.nsecCovering(child) != nil {
+		return dnssecNoZone
+	}
+	_, match, covering := p.closestEncloser(child)
+	switch {
+	case match == nil:
+		return dnssecBogus
+	case covering == nil:
+		switch {
+		case hasType(match.TypeBitMap, dns.TypeDS):
+			return dnssecBogus
+		case hasType(match.TypeBitMap, dns.TypeNS) && !hasType(match.TypeBitMap, dns.TypeSOA):
+			return dnssecInsecure
+		}
+		return dnssecNoZone
+	case covering.Flags&1 != 0:
+		return dnssecInsecure
+	}
+	return dnssecNoZone
+}
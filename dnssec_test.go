@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone signed in memory with an NSEC or NSEC3 chain. Zones
+// without a key are left unsigned.
+type testZone struct {
+	apex    string
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	nsec3   bool
+	optOut  bool
+	records map[string][]dns.RR
+	// chain holds the names with an NSEC3 record.
+	chain map[string]bool
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func newTestZone(apex string, signed bool) *testZone {
+	z := &testZone{apex: apex, records: make(map[string][]dns.RR), chain: make(map[string]bool)}
+	z.add(apex + " 300 IN SOA ns.invalid. hostmaster.invalid. 1 7200 900 86400 300")
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			panic(err)
+		}
+		z.signer = priv.(crypto.Signer)
+		z.records[apex] = append(z.records[apex], z.key)
+	}
+	return z
+}
+
+func (z *testZone) add(s string) {
+	rr := mustRR(s)
+	name := strings.ToLower(rr.Header().Name)
+	z.records[name] = append(z.records[name], rr)
+}
+
+// delegate adds the NS record of child, and its DS if child is signed.
+func (z *testZone) delegate(child *testZone) {
+	z.add(child.apex + " 300 IN NS ns." + child.apex)
+	if child.key != nil {
+		z.records[child.apex] = append(z.records[child.apex], child.key.ToDS(dns.SHA256))
+	}
+}
+
+// types returns the types at name for its NSEC or NSEC3 bitmap.
+func (z *testZone) types(name string) []uint16 {
+	seen := map[uint16]bool{dns.TypeRRSIG: true}
+	if !z.nsec3 {
+		seen[dns.TypeNSEC] = true
+	}
+	for _, rr := range z.records[name] {
+		seen[rr.Header().Rrtype] = true
+	}
+	types := make([]uint16, 0, len(seen))
+	for t := range seen {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// unsignedDelegation reports whether name is a delegation without a DS.
+func (z *testZone) unsignedDelegation(name string) bool {
+	if name == z.apex {
+		return false
+	}
+	ns := false
+	for _, rr := range z.records[name] {
+		switch rr.Header().Rrtype {
+		case dns.TypeNS:
+			ns = true
+		case dns.TypeDS:
+			return false
+		}
+	}
+	return ns
+}
+
+// sign adds the NSEC or NSEC3 chain and signs every RRset but the NS sets of
+// delegations.
+func (z *testZone) sign() {
+	if z.key == nil {
+		return
+	}
+	names := make([]string, 0, len(z.records))
+	for name := range z.records {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	if z.nsec3 {
+		type hashed struct{ hash, name string }
+		var chain []hashed
+		for _, name := range names {
+			if z.optOut && z.unsignedDelegation(name) {
+				continue
+			}
+			chain = append(chain, hashed{dns.HashName(name, dns.SHA1, 1, "ab"), name})
+			z.chain[name] = true
+		}
+		sort.Slice(chain, func(i, j int) bool { return chain[i].hash < chain[j].hash })
+		var flags uint8
+		if z.optOut {
+			flags = 1
+		}
+		for i, h := range chain {
+			z.add(fmt.Sprintf("%s.%s 300 IN NSEC3 1 %d 1 ab %s", strings.ToLower(h.hash), z.apex, flags, chain[(i+1)%len(chain)].hash))
+			owner := strings.ToLower(h.hash) + "." + z.apex
+			nsec3 := z.records[owner][0].(*dns.NSEC3)
+			nsec3.TypeBitMap = z.types(h.name)
+		}
+	} else {
+		for i, name := range names {
+			z.records[name] = append(z.records[name], &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: z.types(name),
+			})
+		}
+	}
+	now := time.Now()
+	for name, rrs := range z.records {
+		sets, _ := rrsets(rrs)
+		for _, set := range sets {
+			if set[0].Header().Rrtype == dns.TypeNS && name != z.apex {
+				continue
+			}
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				Algorithm:  z.key.Algorithm,
+				SignerName: z.apex,
+				KeyTag:     z.key.KeyTag(),
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				Expiration: uint32(now.Add(time.Hour).Unix()),
+			}
+			if err := sig.Sign(z.signer, set); err != nil {
+				panic(err)
+			}
+			z.records[name] = append(z.records[name], sig)
+		}
+	}
+}
+
+// rrset returns copies of the records of type t at name and their
+// signatures.
+func (z *testZone) rrset(name string, t uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range z.records[name] {
+		if sig, ok := rr.(*dns.RRSIG); rr.Header().Rrtype == t || ok && sig.TypeCovered == t {
+			set = append(set, dns.Copy(rr))
+		}
+	}
+	return set
+}
+
+// denial returns the NSEC or NSEC3 records, with their signatures, proving
+// that name does not exist below closest, or has no other types if it is
+// closest itself.
+func (z *testZone) denial(name, closest string) []dns.RR {
+	proven := []string{name, wildcardOf(closest)}
+	if z.nsec3 {
+		for !z.chain[closest] {
+			closest = parentName(closest)
+		}
+		proven = []string{closest}
+		if closest != name {
+			proven = append(proven, nextCloser(name, closest), wildcardOf(closest))
+		}
+	}
+	var out []dns.RR
+	for owner, rrs := range z.records {
+		for _, rr := range rrs {
+			match := false
+			for _, n := range proven {
+				switch rr := rr.(type) {
+				case *dns.NSEC:
+					match = match || strings.EqualFold(owner, n) || nsecCovers(rr, n)
+				case *dns.NSEC3:
+					match = match || rr.Match(n) || rr.Cover(n)
+				}
+			}
+			if match {
+				out = append(out, z.rrset(owner, rr.Header().Rrtype)...)
+			}
+		}
+	}
+	return out
+}
+
+// testZones answers queries from a set of zones, as an upstream would.
+type testZones []*testZone
+
+// zoneFor returns the closest zone holding name and qtype. DS records live
+// in the parent zone.
+func (zs testZones) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range zs {
+		if !dns.IsSubDomain(z.apex, name) || qtype == dns.TypeDS && z.apex == name && name != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.apex) > dns.CountLabel(best.apex) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (zs testZones) answer(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	name = strings.ToLower(name)
+	z := zs.zoneFor(name, qtype)
+	if set := z.rrset(name, qtype); len(set) > 0 {
+		m.Answer = set
+		return m
+	}
+	m.Ns = z.rrset(z.apex, dns.TypeSOA)
+	closest := name
+	if len(z.records[name]) == 0 {
+		m.Rcode = dns.RcodeNameError
+		for closest = parentName(name); len(z.records[closest]) == 0; closest = parentName(closest) {
+		}
+	}
+	m.Ns = append(m.Ns, z.denial(name, closest)...)
+	return m
+}
+
+// newTestZones builds a signed root with these zones below it:
+//
+//	example.test.          NSEC
+//	n3.test.               NSEC3
+//	optout.test.           NSEC3 with opt-out
+//	insecure.test.         unsigned, delegated without a DS
+//	unsigned.optout.test.  unsigned, left out of the NSEC3 chain
+//
+// bad.example.test. has an A record changed after it was signed.
+func newTestZones() (zs testZones, anchor string) {
+	root := newTestZone(".", true)
+	tld := newTestZone("test.", true)
+	example := newTestZone("example.test.", true)
+	n3 := newTestZone("n3.test.", true)
+	n3.nsec3 = true
+	optOut := newTestZone("optout.test.", true)
+	optOut.nsec3, optOut.optOut = true, true
+	insecure := newTestZone("insecure.test.", false)
+	unsigned := newTestZone("unsigned.optout.test.", false)
+
+	root.delegate(tld)
+	tld.delegate(example)
+	tld.delegate(n3)
+	tld.delegate(optOut)
+	tld.delegate(insecure)
+	optOut.delegate(unsigned)
+	example.add("www.example.test. 300 IN A 192.0.2.1")
+	example.add("bad.example.test. 300 IN A 192.0.2.2")
+	n3.add("www.n3.test. 300 IN A 192.0.2.3")
+	optOut.add("www.optout.test. 300 IN A 192.0.2.4")
+	insecure.add("www.insecure.test. 300 IN A 192.0.2.5")
+	unsigned.add("www.unsigned.optout.test. 300 IN A 192.0.2.6")
+
+	zs = testZones{root, tld, example, n3, optOut, insecure, unsigned}
+	for _, z := range zs {
+		z.sign()
+	}
+	example.records["bad.example.test."][0].(*dns.A).A = net.ParseIP("192.0.2.66")
+	return zs, root.key.ToDS(dns.SHA256).String()
+}
+
+func TestValidator(t *testing.T) {
+	zs, anchor := newTestZones()
+	v, err := NewValidator("dnssec", &DNSSECConfig{TrustAnchors: []string{anchor}}, &Config{}, zs.answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripDenial := func(m *dns.Msg) {
+		m.Ns = stripDNSSEC(m.Ns, dns.TypeSOA)
+	}
+	for _, c := range []struct {
+		name   string
+		qtype  uint16
+		change func(*dns.Msg)
+		state  dnssecState
+		ede    uint16
+	}{
+		{"www.example.test.", dns.TypeA, nil, dnssecSecure, 0},
+		{"www.n3.test.", dns.TypeA, nil, dnssecSecure, 0},
+		{"bad.example.test.", dns.TypeA, nil, dnssecBogus, dns.ExtendedErrorCodeDNSBogus},
+		{"www.example.test.", dns.TypeA, func(m *dns.Msg) { m.Answer = stripDNSSEC(m.Answer, dns.TypeA) }, dnssecBogus, dns.ExtendedErrorCodeRRSIGsMissing},
+		{"nope.example.test.", dns.TypeA, nil, dnssecSecure, 0},
+		{"www.example.test.", dns.TypeAAAA, nil, dnssecSecure, 0},
+		{"nope.example.test.", dns.TypeA, stripDenial, dnssecBogus, dns.ExtendedErrorCodeNSECMissing},
+		{"nope.n3.test.", dns.TypeA, nil, dnssecSecure, 0},
+		{"www.n3.test.", dns.TypeAAAA, nil, dnssecSecure, 0},
+		{"nope.n3.test.", dns.TypeA, stripDenial, dnssecBogus, dns.ExtendedErrorCodeNSECMissing},
+		{"www.insecure.test.", dns.TypeA, nil, dnssecInsecure, 0},
+		{"www.unsigned.optout.test.", dns.TypeA, nil, dnssecInsecure, 0},
+	} {
+		r := zs.answer(c.name, c.qtype)
+		if c.change != nil {
+			c.change(r)
+		}
+		res := v.Validate(dns.Question{Name: c.name, Qtype: c.qtype, Qclass: dns.ClassINET}, r)
+		if res.state != c.state || res.ede != c.ede {
+			t.Errorf("%s %s: got %v (ede %d, %s), want %v (ede %d)", c.name, dns.TypeToString[c.qtype], res.state, res.ede, res.reason, c.state, c.ede)
+		}
+	}
+}
+
+// TestValidatorInsecureDefault checks that names routed by a client group or
+// a type mapping are not validated by default.
+func TestValidatorInsecureDefault(t *testing.T) {
+	zs, anchor := newTestZones()
+	config := &Config{
+		ClientGroups: map[string]*ClientGroupConfig{
+			"lan": {Mapping: map[string]UpstreamRefs{"example.test": {"192.0.2.53"}}},
+		},
+		TypeMapping: map[string]map[string]UpstreamRefs{
+			"A": {"n3.test": {"192.0.2.53"}},
+		},
+	}
+	v, err := NewValidator("dnssec", &DNSSECConfig{TrustAnchors: []string{anchor}}, config, zs.answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bad.example.test.", "nope.n3.test."} {
+		r := zs.answer(name, dns.TypeA)
+		r.Answer = stripDNSSEC(r.Answer, dns.TypeA)
+		r.Ns = stripDNSSEC(r.Ns, dns.TypeSOA)
+		if res := v.Validate(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, r); res.state != dnssecInsecure {
+			t.Errorf("%s: got %v (%s), want insecure", name, res.state, res.reason)
+		}
+	}
+}
+
+// TestGoogleHttpsUpstreamDNSSEC validates answers fetched through the JSON
+// API, which only returns signatures and denial records when asked with do.
+func TestGoogleHttpsUpstreamDNSSEC(t *testing.T) {
+	zs, anchor := newTestZones()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		qtype, err := strconv.ParseUint(params.Get("type"), 10, 16)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := zs.answer(params.Get("name"), uint16(qtype))
+		if params.Get("do") != "1" {
+			m.Answer = stripDNSSEC(m.Answer, uint16(qtype))
+			m.Ns = stripDNSSEC(m.Ns, uint16(qtype))
+		}
+		resp := GoogleDnsHttpsResponse{
+			Status:   m.Rcode,
+			RD:       true,
+			RA:       true,
+			CD:       params.Get("cd") == "1",
+			Question: []GoogleDnsHttpsQuestion{{m.Question[0].Name, m.Question[0].Qtype}},
+		}
+		convert := func(rrs []dns.RR) []GoogleDnsHttpsAnswer {
+			var out []GoogleDnsHttpsAnswer
+			for _, rr := range rrs {
+				h := rr.Header()
+				out = append(out, GoogleDnsHttpsAnswer{h.Name, h.Rrtype, h.Ttl, strings.TrimPrefix(rr.String(), h.String())})
+			}
+			return out
+		}
+		resp.Answer, resp.Authority = convert(m.Answer), convert(m.Ns)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer hs.Close()
+
+	up := &GoogleHttpsUpstream{Client: hs.Client(), URL: hs.URL}
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		setDNSSECOK(m)
+		r, err := up.Exchange(context.Background(), m)
+		if err != nil {
+			t.Errorf("%s %s: %v", name, dns.TypeToString[qtype], err)
+			return nil
+		}
+		return r
+	}
+	v, err := NewValidator("dnssec", &DNSSECConfig{TrustAnchors: []string{anchor}}, &Config{}, exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		qtype uint16
+		state dnssecState
+	}{
+		{"www.example.test.", dns.TypeA, dnssecSecure},
+		{"nope.example.test.", dns.TypeA, dnssecSecure},
+		{"nope.n3.test.", dns.TypeA, dnssecSecure},
+		{"bad.example.test.", dns.TypeA, dnssecBogus},
+		{"www.insecure.test.", dns.TypeA, dnssecInsecure},
+	} {
+		r := exchange(c.name, c.qtype)
+		if r == nil {
+			continue
+		}
+		res := v.Validate(dns.Question{Name: c.name, Qtype: c.qtype, Qclass: dns.ClassINET}, r)
+		if res.state != c.state {
+			t.Errorf("%s %s: got %v (%s), want %v", c.name, dns.TypeToString[c.qtype], res.state, res.reason, c.state)
+		}
+	}
+}
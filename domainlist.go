@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// domainTrie maps domains to upstreams by longest suffix match. Each level
+// holds one label, starting from the top-level domain, so a lookup costs one
+// map access per label however many domains are stored.
+type domainTrie struct {
+	children  map[string]*domainTrie
+	route     string
+	upstreams []Upstream
+}
+
+// normalizeDomain lowercases domain and strips trailing dots.
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimRight(domain, "."))
+}
+
+// nextLabel splits the last label off name.
+func nextLabel(name string) (label, rest string) {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i+1:], name[:i]
+	}
+	return name, ""
+}
+
+// Insert routes domain and its subdomains to upstreams, replacing what was
+// there. The empty domain is the default route.
+func (t *domainTrie) Insert(domain string, upstreams []Upstream) {
+	domain = normalizeDomain(domain)
+	node := t
+	for name := domain; name != ""; {
+		var label string
+		label, name = nextLabel(name)
+		child := node.children[label]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			child = new(domainTrie)
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.route, node.upstreams = domain, upstreams
+}
+
+// Lookup returns the longest inserted suffix of domain and its upstreams.
+// domain must be normalized.
+func (t *domainTrie) Lookup(domain string) (route string, upstreams []Upstream) {
+	route, upstreams = t.route, t.upstreams
+	node := t
+	for name := domain; name != ""; {
+		var label string
+		label, name = nextLabel(name)
+		if node = node.children[label]; node == nil {
+			break
+		}
+		if node.upstreams != nil {
+			route, upstreams = node.route, node.upstreams
+		}
+	}
+	return
+}
+
+// domainListEntry is a domain read from a domain list, with the servers its
+// line names, if any.
+type domainListEntry struct {
+	line    int
+	domain  string
+	servers []string
+}
+
+// readDomainList reads path in one of these formats:
+//
+//	plain    one domain per line, # starts a comment
+//	dnsmasq  server=/domain/.../ip[#port] lines, as used by dnsmasq-china-list
+//	adguard  ||domain^ rules and [/domain/.../]server ... upstream rules
+//
+// Lines of other kinds are skipped. A server of # stands for the default route.
+func readDomainList(path, format string) ([]domainListEntry, error) {
+	var parse func(line string) ([]string, []string, error)
+	switch format {
+	case "", "plain":
+		parse = parsePlainLine
+	case "dnsmasq":
+		parse = parseDnsmasqLine
+	case "adguard":
+		parse = parseAdGuardLine
+	default:
+		return nil, fmt.Errorf("unknown format %q, want plain, dnsmasq or adguard", format)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []domainListEntry
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		domains, servers, err := parse(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		for _, d := range domains {
+			// An empty domain would replace the default route.
+			if d != "" {
+				entries = append(entries, domainListEntry{lineno, d, servers})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func parsePlainLine(line string) ([]string, []string, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if line == "" {
+		return nil, nil, nil
+	}
+	if line = strings.TrimLeft(line, "*."); line == "" {
+		return nil, nil, nil
+	}
+	return []string{line}, nil, nil
+}
+
+func parseDnsmasqLine(line string) ([]string, []string, error) {
+	if !strings.HasPrefix(line, "server=/") {
+		return nil, nil, nil
+	}
+	parts := strings.Split(line[len("server=/"):], "/")
+	if len(parts) < 2 {
+		return nil, nil, fmt.Errorf("want server=/domain/ip, got %q", line)
+	}
+	server := parts[len(parts)-1]
+	var servers []string
+	if server != "" {
+		// dnsmasq writes the port after a #, and a lone # for the default
+		// servers.
+		if i := strings.IndexByte(server, '#'); i > 0 {
+			server = net.JoinHostPort(server[:i], server[i+1:])
+		}
+		servers = []string{server}
+	}
+	return parts[:len(parts)-1], servers, nil
+}
+
+func parseAdGuardLine(line string) ([]string, []string, error) {
+	switch {
+	case line == "", line[0] == '!', line[0] == '#':
+		return nil, nil, nil
+	case strings.HasPrefix(line, "||"):
+		rule := line[2:]
+		if i := strings.IndexByte(rule, '$'); i >= 0 {
+			rule = rule[:i]
+		}
+		if !strings.HasSuffix(rule, "^") {
+			return nil, nil, nil
+		}
+		return []string{strings.TrimSuffix(rule, "^")}, nil, nil
+	case strings.HasPrefix(line, "[/"):
+		end := strings.Index(line, "/]")
+		if end < 0 {
+			return nil, nil, fmt.Errorf("want [/domain/]server, got %q", line)
+		}
+		return strings.Split(line[2:end], "/"), strings.Fields(line[end+2:]), nil
+	}
+	return nil, nil, nil
+}
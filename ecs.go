@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Source prefix lengths sent by default, as RFC 7871 section 11.1 recommends.
+const (
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+// nonPublicNets are the ranges whose addresses say nothing about where a
+// client is.
+var nonPublicNets = func() *IPSet {
+	s := NewIPSet()
+	s.AddStrings("", defaultRebindingNets)
+	return s
+}()
+
+// ECSPolicy decides which edns0 subnet is sent to an upstream. A subnet the
+// client sent itself is passed on, shortened to the source prefix length,
+// unless the policy is off.
+type ECSPolicy struct {
+	Disabled bool
+	// Subnet is a fixed subnet to send.
+	Subnet *net.IPNet
+	// Client sends the subnet Config.ECSClients maps the client to, or the
+	// client's address if it is public, and the detected public IP otherwise.
+	// Without Subnet or Client, the detected IP is used.
+	Client bool
+	// passOn leaves the message alone, for upstreams whose members apply
+	// their own policies.
+	passOn bool
+}
+
+// ParseECSPolicy parses "auto" (or empty), "off", "client", or a fixed IP or
+// CIDR.
+func ParseECSPolicy(s string) (ECSPolicy, error) {
+	switch s {
+	case "", "auto":
+		return ECSPolicy{}, nil
+	case "off":
+		return ECSPolicy{Disabled: true}, nil
+	case "client":
+		return ECSPolicy{Client: true}, nil
+	}
+	subnet, err := parseIPNet(s)
+	if err != nil {
+		return ECSPolicy{}, fmt.Errorf("want auto, off, client, an IP or a CIDR, got %q", s)
+	}
+	return ECSPolicy{Subnet: subnet}, nil
+}
+
+// ECSSource is what policies draw the subnet from for one query.
+type ECSSource struct {
+	Detected net.IP
+	// Client is the address of the client, nil for the server's own queries.
+	Client net.IP
+	// Mapped is the subnet Config.ECSClients maps Client to, if any.
+	Mapped   *net.IPNet
+	PrefixV4 uint8
+	PrefixV6 uint8
+	// Group is the policy of the client's group, if it sets one. It replaces
+	// the policies of the upstreams, chinadns members included.
+	Group *ECSPolicy
+}
+
+// policy returns the policy to apply instead of p.
+func (src ECSSource) policy(p ECSPolicy) ECSPolicy {
+	if src.Group != nil {
+		return *src.Group
+	}
+	return p
+}
+
+// limit masks ip to bits, or to the source prefix length if that is shorter.
+func (src ECSSource) limit(ip net.IP, bits uint8) (net.IP, uint8) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if bits > src.PrefixV4 {
+			bits = src.PrefixV4
+		}
+		return ip4.Mask(net.CIDRMask(int(bits), net.IPv4len*8)), bits
+	}
+	if bits > src.PrefixV6 {
+		bits = src.PrefixV6
+	}
+	return ip.Mask(net.CIDRMask(int(bits), net.IPv6len*8)), bits
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !nonPublicNets.Contains(ip)
+}
+
+type ecsSourceKey struct{}
+
+func withECSSource(ctx context.Context, src ECSSource) context.Context {
+	return context.WithValue(ctx, ecsSourceKey{}, src)
+}
+
+// ecsSourceFrom returns the source stored in ctx, or the detected IP with the
+// default prefix lengths.
+func ecsSourceFrom(ctx context.Context) ECSSource {
+	if src, ok := ctx.Value(ecsSourceKey{}).(ECSSource); ok {
+		return src
+	}
+	return ECSSource{
+		Detected: myIP.GetIP(),
+		PrefixV4: defaultECSPrefixV4,
+		PrefixV6: defaultECSPrefixV6,
+	}
+}
+
+func (p ECSPolicy) Apply(m *dns.Msg, src ECSSource) {
+	switch {
+	case p.passOn:
+		return
+	case p.Disabled:
+		removeEdns0Subnet(m)
+		return
+	}
+	if e := extractEdns0Subnet(m); e != nil {
+		if e.Address != nil {
+			ip, bits := src.limit(e.Address, e.SourceNetmask)
+			removeEdns0Subnet(m)
+			appendEdns0Subnet(m, ip, bits)
+		}
+		return
+	}
+	if ip, bits := p.subnet(src); ip != nil {
+		appendEdns0Subnet(m, ip, bits)
+	}
+}
+
+// subnet returns the subnet to send when the client sent none.
+func (p ECSPolicy) subnet(src ECSSource) (net.IP, uint8) {
+	switch {
+	case p.Subnet != nil:
+		ones, _ := p.Subnet.Mask.Size()
+		return p.Subnet.IP, uint8(ones)
+	case p.Client && src.Mapped != nil:
+		ones, _ := src.Mapped.Mask.Size()
+		return src.Mapped.IP, uint8(ones)
+	case p.Client && isPublicIP(src.Client):
+		return src.limit(src.Client, net.IPv6len*8)
+	case src.Detected != nil && !src.Detected.IsLoopback():
+		return src.limit(src.Detected, net.IPv6len*8)
+	}
+	return nil, 0
+}
+
+// clientSubnet returns the subnet sent for req if it depends on the client,
+// so that answers tailored to one client are cached apart, and "" if it is
+// the same for everyone.
+func (p ECSPolicy) clientSubnet(req *dns.Msg, src ECSSource) string {
+	if p.Disabled {
+		return ""
+	}
+	if e := extractEdns0Subnet(req); e != nil && e.Address != nil {
+		ip, bits := src.limit(e.Address, e.SourceNetmask)
+		return ip.String() + "/" + strconv.Itoa(int(bits))
+	}
+	if p.Client && src.Mapped != nil {
+		return src.Mapped.String()
+	}
+	if p.Client && isPublicIP(src.Client) {
+		ip, bits := src.limit(src.Client, net.IPv6len*8)
+		return ip.String() + "/" + strconv.Itoa(int(bits))
+	}
+	return ""
+}
+
+// ecsClient maps the clients in a CIDR to the subnet sent for them.
+type ecsClient struct {
+	clients *net.IPNet
+	subnet  *net.IPNet
+}
+
+// newECSClients parses Config.ECSClients, most specific clients first.
+func newECSClients(path string, m map[string]string) ([]ecsClient, error) {
+	table := make([]ecsClient, 0, len(m))
+	for k, v := range m {
+		clients, err := parseIPNet(k)
+		if err != nil {
+			return nil, configError(fmt.Sprintf("%s[%q]", path, k), err)
+		}
+		subnet, err := parseIPNet(v)
+		if err != nil {
+			return nil, configError(fmt.Sprintf("%s[%q]", path, k), err)
+		}
+		table = append(table, ecsClient{clients, subnet})
+	}
+	sort.Slice(table, func(i, j int) bool {
+		oi, _ := table[i].clients.Mask.Size()
+		oj, _ := table[j].clients.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return table[i].clients.String() < table[j].clients.String()
+	})
+	return table, nil
+}
+
+// mappedSubnet returns the subnet ip is mapped to, or nil.
+func mappedSubnet(table []ecsClient, ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	for _, c := range table {
+		if c.clients.Contains(ip) {
+			return c.subnet
+		}
+	}
+	return nil
+}
+
+func removeEdns0Subnet(m *dns.Msg) {
+	for _, rr := range m.Extra {
+		o, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		opts := o.Option[:0]
+		for _, opt := range o.Option {
+			if _, ok := opt.(*dns.EDNS0_SUBNET); !ok {
+				opts = append(opts, opt)
+			}
+		}
+		o.Option = opts
+	}
+}
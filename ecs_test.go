@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startECSRecorder runs a UDP server answering A queries with ip, and returns
+// its address and the subnet of the last query it got, "" if it had none.
+func startECSRecorder(t *testing.T, ip string) (addr string, last func() string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	subnet := ""
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		subnet = ""
+		if e := extractEdns0Subnet(req); e != nil {
+			subnet = e.Address.String()
+		}
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String(), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return subnet
+	}
+}
+
+// TestChinaDNSGroupECS checks that the ECS policy of a client group applies
+// to the members of a chinadns upstream too.
+func TestChinaDNSGroupECS(t *testing.T) {
+	oldIP := myIP
+	myIP = new(MyIP)
+	myIP.SetIP(net.ParseIP("203.0.113.7"))
+	defer func() { myIP = oldIP }()
+
+	// The domestic answer is not in cn_ips, so both sides are waited for.
+	domestic, domesticSubnet := startECSRecorder(t, "198.51.100.1")
+	trusted, trustedSubnet := startECSRecorder(t, "198.51.100.2")
+	s, err := NewHandlerState(&Config{
+		ChinaDNS: &ChinaDNSConfig{
+			Domestic: UpstreamRefs{domestic},
+			Trusted:  UpstreamRefs{trusted},
+			CNIPs:    []string{"192.0.2.0/24"},
+		},
+		ClientGroups: map[string]*ClientGroupConfig{
+			"private": {Clients: []string{"192.0.2.10"}, ECS: "off"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i, c := range []struct {
+		client string
+		subnet string
+	}{
+		{"192.0.2.20", "203.0.113.0"},
+		{"192.0.2.10", ""},
+	} {
+		client := &net.UDPAddr{IP: net.ParseIP(c.client), Port: 53}
+		req := new(dns.Msg)
+		// A name per client keeps the second query out of the cache.
+		req.SetQuestion(c.client+".example.com.", dns.TypeA)
+		if _, err := s.resolve(client, req, req.Question[0], s.clientGroup(client), &QueryLogRecord{}); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := domesticSubnet(); got != c.subnet {
+			t.Errorf("%s: domestic got subnet %q, want %q", c.client, got, c.subnet)
+		}
+		if got := trustedSubnet(); got != c.subnet {
+			t.Errorf("%s: trusted got subnet %q, want %q", c.client, got, c.subnet)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// IPSet is a set of CIDRs stored in binary prefix tries, one per address
+// family, so lookups cost at most 32 or 128 steps regardless of size.
+type IPSet struct {
+	v4, v6 ipTrieNode
+	size   int
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	terminal bool
+}
+
+func NewIPSet() *IPSet {
+	return new(IPSet)
+}
+
+func (s *IPSet) Add(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	root, ip := &s.v6, n.IP.To16()
+	// An IPv4-mapped CIDR such as ::ffff:10.0.0.0/104 has a 128-bit mask but
+	// goes in the IPv4 trie, where Match looks up mapped addresses.
+	if ip4 := n.IP.To4(); ip4 != nil && bits != 0 && ones >= bits-32 {
+		root, ip, ones = &s.v4, ip4, ones-(bits-32)
+	}
+	node := root
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			return
+		}
+		bit := ip[i/8] >> uint(7-i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(ipTrieNode)
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*ipTrieNode{}
+	s.size++
+}
+
+func (s *IPSet) Contains(ip net.IP) bool {
+	_, ok := s.Match(ip)
+	return ok
+}
+
+// Match returns the prefix length of the CIDR in s that contains ip.
+func (s *IPSet) Match(ip net.IP) (bits int, ok bool) {
+	if s == nil {
+		return 0, false
+	}
+	node := &s.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		node, ip = &s.v4, ip4
+	} else if ip = ip.To16(); ip == nil {
+		return 0, false
+	}
+	for i := 0; i < len(ip)*8; i++ {
+		if node.terminal {
+			return i, true
+		}
+		if node = node.children[ip[i/8]>>uint(7-i%8)&1]; node == nil {
+			return 0, false
+		}
+	}
+	return len(ip) * 8, node.terminal
+}
+
+// Len returns the number of CIDRs added.
+func (s *IPSet) Len() int {
+	return s.size
+}
+
+// AddStrings adds IPs or CIDRs, reporting errors under path.
+func (s *IPSet) AddStrings(path string, list []string) error {
+	for i, v := range list {
+		n, err := parseIPNet(v)
+		if err != nil {
+			return configError(fmt.Sprintf("%s[%d]", path, i), err)
+		}
+		s.Add(n)
+	}
+	return nil
+}
+
+// AddFile adds one IP or CIDR per line from path. Blank lines and lines
+// starting with # are skipped.
+func (s *IPSet) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		n, err := parseIPNet(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		s.Add(n)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPSet(t *testing.T) {
+	s := NewIPSet()
+	if err := s.AddStrings("nets", []string{
+		"10.0.0.0/8",
+		"192.0.2.1",
+		"2001:db8::/32",
+		"::ffff:172.16.0.0/108",
+		"::ffff:0:0/96",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len(); n != 5 {
+		t.Errorf("Len() = %d, want 5", n)
+	}
+	tests := []struct {
+		ip   string
+		bits int
+		ok   bool
+	}{
+		{"10.1.2.3", 0, true},
+		{"192.0.2.1", 0, true},
+		{"192.0.2.2", 0, true},
+		{"::ffff:10.1.2.3", 0, true},
+		{"2001:db8:1::1", 32, true},
+		{"2001:db9::1", 0, false},
+		{"::1", 0, false},
+	}
+	for _, tt := range tests {
+		bits, ok := s.Match(net.ParseIP(tt.ip))
+		if ok != tt.ok || ok && tt.bits != 0 && bits != tt.bits {
+			t.Errorf("Match(%s) = %d, %v, want %d, %v", tt.ip, bits, ok, tt.bits, tt.ok)
+		}
+	}
+}
+
+func TestIPSetMapped(t *testing.T) {
+	s := NewIPSet()
+	if err := s.AddStrings("nets", []string{"::ffff:10.0.0.0/104", "::ffff:192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		bits int
+		ok   bool
+	}{
+		{"10.9.9.9", 8, true},
+		{"::ffff:10.9.9.9", 8, true},
+		{"192.0.2.1", 32, true},
+		{"11.0.0.1", 0, false},
+		{"2001:db8::1", 0, false},
+	}
+	for _, tt := range tests {
+		bits, ok := s.Match(net.ParseIP(tt.ip))
+		if ok != tt.ok || bits != tt.bits {
+			t.Errorf("Match(%s) = %d, %v, want %d, %v", tt.ip, bits, ok, tt.bits, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const maxCNAMEChain = 8
+
+// LocalZone answers names from static records, hosts files and zone files,
+// authoritatively. Inside a zone, names without records get NXDOMAIN; outside
+// any zone, only names with records are answered and the rest go upstream.
+type LocalZone struct {
+	names map[string][]dns.RR
+	// ents are names that only exist as ancestors of names with records.
+	ents  map[string]bool
+	zones map[string]*dns.SOA
+}
+
+func NewLocalZone() *LocalZone {
+	return &LocalZone{
+		names: make(map[string][]dns.RR),
+		ents:  make(map[string]bool),
+		zones: make(map[string]*dns.SOA),
+	}
+}
+
+func (z *LocalZone) Add(rr dns.RR) {
+	if soa, ok := rr.(*dns.SOA); ok {
+		z.zones[strings.ToLower(soa.Hdr.Name)] = soa
+		return
+	}
+	name := strings.ToLower(rr.Header().Name)
+	z.names[name] = append(z.names[name], rr)
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		z.ents[name[i:]] = true
+	}
+}
+
+// AddZone declares name a local zone, with a made-up SOA for negative answers.
+func (z *LocalZone) AddZone(name string, ttl uint32) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, ok := z.zones[name]; ok {
+		return
+	}
+	z.zones[name] = &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// AddHostsFile adds A and AAAA records for every name in an /etc/hosts style
+// file, and a PTR record for the first name of each address.
+func (z *LocalZone) AddHostsFile(path string, ttl uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ptrs := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Addresses with a zone such as fe80::1%lo0 are skipped.
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			hdr := dns.RR_Header{Name: dns.Fqdn(host), Class: dns.ClassINET, Ttl: ttl}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				z.Add(&dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				z.Add(&dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if reverse, err := dns.ReverseAddr(ip.String()); err == nil && !ptrs[reverse] {
+			ptrs[reverse] = true
+			z.Add(&dns.PTR{
+				Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+				Ptr: dns.Fqdn(fields[1]),
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+// AddZoneFile adds the records of an RFC 1035 zone file, which must have an
+// SOA record. Relative names are taken relative to the root unless the file
+// sets $ORIGIN.
+func (z *LocalZone) AddZoneFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasSOA := false
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			hasSOA = true
+		}
+		z.Add(rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if !hasSOA {
+		return errors.New("no SOA record")
+	}
+	return nil
+}
+
+// zoneOf returns the SOA of the closest zone containing name, or nil.
+func (z *LocalZone) zoneOf(name string) *dns.SOA {
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if soa, ok := z.zones[name[i:]]; ok {
+			return soa
+		}
+	}
+	return z.zones["."]
+}
+
+// Answer answers question qi of req, or returns nil if the name is not local.
+// CNAMEs are followed as long as their targets are local.
+func (z *LocalZone) Answer(req *dns.Msg, qi int) *dns.Msg {
+	if z == nil {
+		return nil
+	}
+	q := req.Question[qi]
+	name := strings.ToLower(q.Name)
+	soa := z.zoneOf(name)
+	rrs, exists := z.names[name]
+	if !exists && soa == nil {
+		return nil
+	}
+	m := localReply(req, qi, dns.RcodeSuccess)
+	m.Authoritative = true
+	if !exists && !z.ents[name] && !(soa != nil && strings.EqualFold(soa.Hdr.Name, name)) {
+		m.Rcode = dns.RcodeNameError
+	}
+	for hops := 0; exists && hops < maxCNAMEChain; hops++ {
+		found := false
+		next := ""
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; {
+			case t == q.Qtype || q.Qtype == dns.TypeANY:
+				m.Answer = append(m.Answer, dns.Copy(rr))
+				found = true
+			case t == dns.TypeCNAME:
+				m.Answer = append(m.Answer, dns.Copy(rr))
+				next = strings.ToLower(rr.(*dns.CNAME).Target)
+			}
+		}
+		if found || next == "" {
+			break
+		}
+		rrs, exists = z.names[next]
+	}
+	if q.Qtype == dns.TypeSOA && soa != nil && strings.EqualFold(soa.Hdr.Name, name) {
+		m.Answer = append(m.Answer, dns.Copy(soa))
+	}
+	if len(m.Answer) == 0 && soa != nil {
+		m.Ns = []dns.RR{dns.Copy(soa)}
+	}
+	return m
+}
+
+// NewLocalZoneFromConfig builds a LocalZone from c, reporting errors under
+// path.
+func NewLocalZoneFromConfig(path string, c *LocalConfig) (*LocalZone, error) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	z := NewLocalZone()
+	for i, name := range c.Zones {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, configError(fmt.Sprintf("%s.zones[%d]", path, i), fmt.Errorf("invalid domain %q", name))
+		}
+		z.AddZone(name, ttl)
+	}
+	for i, s := range c.Records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, configError(fmt.Sprintf("%s.records[%d]", path, i), err)
+		}
+		if rr != nil {
+			z.Add(rr)
+		}
+	}
+	for i, f := range c.HostsFiles {
+		if err := z.AddHostsFile(f, ttl); err != nil {
+			return nil, configError(fmt.Sprintf("%s.hosts_files[%d]", path, i), err)
+		}
+	}
+	for i, f := range c.ZoneFiles {
+		if err := z.AddZoneFile(f); err != nil {
+			return nil, configError(fmt.Sprintf("%s.zone_files[%d]", path, i), err)
+		}
+	}
+	return z, nil
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"flag"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"golang.org/x/net/http2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -24,20 +24,17 @@ const (
 var (
 	confFile = flag.String("conf", "config.json", "Specify config json path")
 	daemon   = flag.Bool("d", false, "Run as daemon")
+	watch    = flag.Bool("watch", false, "Reload config when the file changes")
 
-	myIP                *MyIP
-	dnsCache            *DNSCache
-	possibleLoopDomains = []string{GoogleDnsHttpsDomain}
-	dnsQueryTimeoutSec  time.Duration
-	fallbackUpstream    *TcpUdpUpstream
+	myIP *MyIP
 )
 
 type MyHandler struct {
-	upstreamMap map[string][]Upstream
-	cache       *DNSCache
+	state    atomic.Value // *HandlerState
+	queryLog *QueryLogger
 }
 
-func appendEdns0Subnet(m *dns.Msg, addr net.IP) {
+func appendEdns0Subnet(m *dns.Msg, addr net.IP, netmask uint8) {
 	newOpt := true
 	var o *dns.OPT
 	for _, v := range m.Extra {
@@ -56,12 +53,11 @@ func appendEdns0Subnet(m *dns.Msg, addr net.IP) {
 	e.Code = dns.EDNS0SUBNET
 	e.SourceScope = 0
 	e.Address = addr
+	e.SourceNetmask = netmask
 	if e.Address.To4() == nil {
 		e.Family = 2 // IP6
-		e.SourceNetmask = net.IPv6len * 8
 	} else {
 		e.Family = 1 // IP4
-		e.SourceNetmask = net.IPv4len * 8
 	}
 	o.Option = append(o.Option, e)
 	if newOpt {
@@ -69,59 +65,135 @@ func appendEdns0Subnet(m *dns.Msg, addr net.IP) {
 	}
 }
 
-func (h *MyHandler) determineRoute(domain string) (u []Upstream) {
-	for domain != "" && domain[len(domain)-1] == '.' {
-		domain = domain[:len(domain)-1]
-	}
-	avoidLoop := false
-	var ok bool
-	for domain != "" {
-		for _, d := range possibleLoopDomains {
-			if domain == d {
-				avoidLoop = true
-				break
-			}
-		}
-		u, ok = h.upstreamMap[domain]
-		if ok {
-			break
+func (h *MyHandler) State() *HandlerState {
+	return h.state.Load().(*HandlerState)
+}
+
+func (h *MyHandler) SetState(s *HandlerState) {
+	h.state.Store(s)
+}
+
+// exchange queries u, giving up after timeout or when ctx is done.
+func exchange(ctx context.Context, u Upstream, m *dns.Msg, timeout time.Duration) (r *dns.Msg, rtt time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	metricInflight.Inc()
+	defer metricInflight.Dec()
+	start := time.Now()
+	r, err = u.Exchange(ctx, m)
+	rtt = time.Since(start)
+	metricUpstreamDuration.WithLabelValues(u.Name()).Observe(rtt.Seconds())
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			metricUpstreamErrors.WithLabelValues(u.Name(), "timeout").Inc()
+			err = errors.New("single timeout")
+		} else {
+			metricUpstreamErrors.WithLabelValues(u.Name(), "error").Inc()
 		}
-		idx := strings.IndexByte(domain, '.')
-		if idx < 0 {
+		r = nil
+	}
+	return
+}
+
+// localReply answers question qi of req without asking an upstream.
+func localReply(req *dns.Msg, qi int, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	m.Question = req.Question[qi : qi+1]
+	m.RecursionAvailable = true
+	return m
+}
+
+// typeActionReply answers question qi of req as Config.TypeActions says.
+func typeActionReply(req *dns.Msg, qi int, action string) *dns.Msg {
+	switch action {
+	case "nxdomain":
+		return localReply(req, qi, dns.RcodeNameError)
+	case "refused":
+		return localReply(req, qi, dns.RcodeRefused)
+	}
+	m := localReply(req, qi, dns.RcodeSuccess)
+	if action == "rfc8482" {
+		// RFC 8482 section 4.2: a single synthesized HINFO record.
+		q := m.Question[0]
+		m.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: q.Qclass, Ttl: 3600},
+			Cpu: "RFC8482",
+		}}
+	}
+	return m
+}
+
+// resolve answers question q of req from the cache of group, or else from the
+// upstreams routed for it, filling in rec.
+func (st *HandlerState) resolve(client net.Addr, req *dns.Msg, q dns.Question, group *clientGroup, rec *QueryLogRecord) (respMsg *dns.Msg, err error) {
+	var up []Upstream
+	rec.Route, up = st.determineRoute(q.Name, q.Qtype, group)
+	src := st.ecsSource(client)
+	if group != nil {
+		src.Group = group.ecs
+	}
+	ecsOf := func(u Upstream) UpstreamOptions {
+		opts := st.upstreamOptions(u)
+		opts.ECS = src.policy(opts.ECS)
+		return opts
+	}
+	// Any of the upstreams may end up answering, so answers are cached per
+	// client if one of them tailors its answers to the client.
+	var subnet string
+	for _, u := range up {
+		if subnet = ecsOf(u).ECS.clientSubnet(req, src); subnet != "" {
 			break
 		}
-		domain = domain[idx+1:]
 	}
-	if len(u) == 0 {
-		u = h.upstreamMap[""]
+
+	cache := st.cacheFor(group)
+	if respMsg = cache.Get(q, subnet); respMsg != nil {
+		metricCacheHits.Inc()
+		rec.Cache = "hit"
+		respMsg.Id = req.Id
+		return respMsg, nil
 	}
-	if avoidLoop {
-		ups := []Upstream{}
-		for _, s := range u {
-			if _, ok = s.(*GoogleHttpsUpstream); !ok {
-				ups = append(ups, s)
-			}
+	metricCacheMisses.Inc()
+	rec.Cache = "miss"
+
+	ctx := withECSSource(context.Background(), src)
+	for i, u := range up {
+		m := req.Copy()
+		m.Question = []dns.Question{q}
+		opts := ecsOf(u)
+		opts.ECS.Apply(m, src)
+		if st.dnssec != nil {
+			setDNSSECOK(m)
 		}
-		if len(ups) > 0 {
-			u = ups
-		} else {
-			u = []Upstream{fallbackUpstream}
+
+		rec.Upstream = u.Name()
+		rec.ECS = ""
+		if e := extractEdns0Subnet(m); e != nil && e.Address != nil {
+			rec.ECS = e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+		}
+		var rtt time.Duration
+		respMsg, rtt, err = exchange(ctx, u, m, opts.Timeout)
+		rec.RttMs = int64(rtt / time.Millisecond)
+		if err != nil {
+			log.Printf("%s#%d %d/%d %s(%d) rtt=%dms, err=%v", client, m.Id, rec.Index, rec.Total, u.Name(), i, rec.RttMs, err)
+		}
+		if err == nil {
+			break
 		}
 	}
-	return
-}
 
-func (h *MyHandler) ServeDNS(w dns.ResponseWriter, reqMsg *dns.Msg) {
-	var err error
-	addr := myIP.GetIP()
-	if addr != nil && !addr.IsLoopback() {
-		appendEdns0Subnet(reqMsg, addr)
+	if respMsg != nil {
+		cache.Put(q, subnet, respMsg)
 	}
+	return respMsg, err
+}
 
-	type chanResp struct {
-		m   *dns.Msg
-		err error
-	}
+func (h *MyHandler) ServeDNS(w dns.ResponseWriter, reqMsg *dns.Msg) {
+	st := h.State()
+	st.inflight.Add(1)
+	defer st.inflight.Done()
+	group := st.clientGroup(w.RemoteAddr())
 	var respMsg *dns.Msg
 	allQuestions := reqMsg.Question
 	for qi, q := range allQuestions {
@@ -129,47 +201,77 @@ func (h *MyHandler) ServeDNS(w dns.ResponseWriter, reqMsg *dns.Msg) {
 		if !ok {
 			typ = "UnknownType"
 		}
+		rec := &QueryLogRecord{
+			Time:   time.Now(),
+			Client: w.RemoteAddr().String(),
+			ID:     reqMsg.Id,
+			Index:  qi + 1,
+			Total:  len(allQuestions),
+			QName:  q.Name,
+			QType:  typ,
+		}
+		if group != nil {
+			rec.Group = group.name
+		}
+		var err error
+		fromUpstream := false
 
-		respMsg = h.cache.Get(q)
-		if respMsg == nil {
-			up := h.determineRoute(q.Name)
-
-			for i, u := range up {
-				m := reqMsg.Copy()
-				m.Question = allQuestions[qi : qi+1]
-
-				log.Printf("%s#%d %d/%d query %v, type=%s => %s(%d)", w.RemoteAddr(), m.Id, qi+1, len(allQuestions), q.Name, typ, u.Name(), i)
-				ch := make(chan chanResp)
-				go func(i int, u Upstream) {
-					start := time.Now()
-					respMsg, err := u.Exchange(m)
-					log.Printf("%s#%d %d/%d %s(%d) rtt=%dms, err=%v", w.RemoteAddr(), m.Id, qi+1, len(allQuestions), u.Name(), i, time.Since(start)/1e6, err)
-					ch <- chanResp{respMsg, err}
-					close(ch)
-				}(i, u)
-				select {
-				case resp := <-ch:
-					respMsg, err = resp.m, resp.err
-				case <-time.After(dnsQueryTimeoutSec):
-					go func() {
-						<-ch
-					}()
-					respMsg, err = nil, errors.New("single timeout")
-				}
-				if err == nil {
-					break
+		if rule := st.blockedBy(q.Name, group); rule != "" {
+			rec.Route = rule
+			rec.Upstream = "blocked"
+			respMsg = st.blockReply(reqMsg, qi)
+		} else if action := st.typeActions[q.Qtype]; action != "" {
+			rec.Upstream = "local"
+			respMsg = typeActionReply(reqMsg, qi, action)
+		} else if respMsg = st.local.Answer(reqMsg, qi); respMsg != nil {
+			rec.Upstream = "local"
+		} else {
+			fromUpstream = true
+			respMsg, err = st.resolve(w.RemoteAddr(), reqMsg, q, group, rec)
+			respMsg, rec.DNSSEC = st.dnssec.Apply(reqMsg, qi, respMsg)
+			if rec.DNSSEC != "bogus" && st.dns64.wants(w.RemoteAddr(), q, respMsg) {
+				aq := q
+				aq.Qtype = dns.TypeA
+				aRec := *rec
+				if a, aErr := st.resolve(w.RemoteAddr(), reqMsg, aq, group, &aRec); aErr == nil && !st.dnssec.Bogus(aq, a) {
+					if synth := st.dns64.synthesize(reqMsg, qi, respMsg, a); synth != nil {
+						respMsg, err = synth, nil
+						rec.Policy = "dns64"
+					}
 				}
 			}
+		}
 
-			if respMsg != nil {
-				h.cache.Put(q, respMsg)
+		if fromUpstream {
+			var policy string
+			if respMsg, policy = st.applyRPZ(reqMsg, qi, respMsg); policy == "" {
+				respMsg, policy = st.applyRebinding(reqMsg, qi, respMsg)
+			} else if respMsg != nil {
+				err = nil
+			}
+			if policy != "" {
+				rec.Policy = policy
 			}
-		} else {
-			respMsg.Id = reqMsg.Id
-			log.Printf("%s#%d %d/%d query %v, type=%s => cache", w.RemoteAddr(), respMsg.Id, qi+1, len(allQuestions), q.Name, typ)
 		}
 
+		rec.Rcode = rcodeLabel(respMsg)
 		if respMsg != nil {
+			rec.Answers = len(respMsg.Answer)
+		}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		if group.shouldLog(rec) {
+			h.queryLog.Log(rec)
+		}
+		metricQueries.WithLabelValues(typ, rec.Rcode).Inc()
+		if respMsg != nil {
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				if size := clientUDPSize(reqMsg); respMsg.Len() > size {
+					respMsg = respMsg.Copy()
+					respMsg.Truncate(size)
+				}
+			}
 			if err := w.WriteMsg(respMsg); err != nil {
 				log.Printf("WriteMsg: %v", err)
 			}
@@ -184,6 +286,10 @@ func init() {
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "route" {
+		os.Exit(routeCommand(flag.Args()[1:]))
+	}
+
 	if *daemon {
 		newArgs := make([]string, len(os.Args)-1)
 		for i, j := 0, 0; i < len(os.Args); i++ {
@@ -209,18 +315,12 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	dnsQueryTimeoutSec = time.Duration(config.QueryTimeoutSec) * time.Second
-	if dnsQueryTimeoutSec == 0 {
-		dnsQueryTimeoutSec = 5 * time.Second
-	}
-
-	fallbackUpstream = &TcpUdpUpstream{
-		NameServer: AliDNS,
-		Network:    "udp",
-		Dial: (&net.Dialer{
-			Timeout: dnsQueryTimeoutSec,
-		}).Dial,
+	state, err := NewHandlerState(config, nil)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	handler := &MyHandler{}
+	handler.SetState(state)
 
 	myIP = new(MyIP)
 	if config.MyIP == "" {
@@ -236,74 +336,30 @@ func main() {
 		}
 		myIP.SetIP(net.IP{127, 0, 0, 1})
 		myIP.StartTaobaoIPLoop(func(oldIP, newIP net.IP) {
-			dnsCache.Purge()
+			handler.State().purgeCaches()
 		})
 	} else {
 		myIP.SetIP(net.ParseIP(config.MyIP))
 	}
 
-	dial := (&net.Dialer{
-		Timeout: 5 * time.Second,
-	}).Dial
-	if config.Proxy != "" {
-		u, err := url.Parse(config.Proxy)
-		if err != nil {
-			log.Fatalf("invalid proxy url %s: %v", config.Proxy, err)
-		}
-		if dial, err = NewDialFromURL(u); err != nil {
-			log.Fatalln(err)
-		}
-		domain := strings.SplitN(u.Host, ":", 2)[0]
-		if net.ParseIP(domain) == nil {
-			possibleLoopDomains = append(possibleLoopDomains, domain)
-		}
-	}
-	defaultGoogleUpstream := &GoogleHttpsUpstream{
-		Client: &http.Client{
-			Transport: &http2.Transport{
-				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-					conn, err := dial(network, addr)
-					if err != nil {
-						return nil, err
-					}
-					return tls.Client(conn, cfg), nil
-				},
-			},
-			Timeout: 2 * time.Second,
-		},
+	queryLog, err := NewQueryLogger(config.QueryLog)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	handler.queryLog = queryLog
 
-	upstreamMap := make(map[string][]Upstream)
-	for k, v := range config.Mapping {
-		upstreams := []Upstream{}
-		for _, v := range strings.Split(v, ",") {
-			var upstream Upstream
-			if v == "default" {
-				upstream = defaultGoogleUpstream
-			} else {
-				if _, _, err := net.SplitHostPort(v); err != nil {
-					if strings.Contains(err.Error(), "missing port in address") {
-						v += ":53"
-					} else {
-						log.Fatalf("dns server %s invalid: %v", v, err)
-					}
-				}
-				upstream = &TcpUdpUpstream{
-					NameServer: v,
-					Network:    "udp",
-					Dial: (&net.Dialer{
-						Timeout: dnsQueryTimeoutSec,
-					}).Dial,
-				}
-			}
-			upstreams = append(upstreams, upstream)
-		}
-		if len(upstreams) > 0 {
-			upstreamMap[k] = upstreams
+	if config.HttpListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if ring := queryLog.Ring(); ring != nil {
+			mux.Handle("/querylog", ring)
 		}
-	}
-	if _, ok := upstreamMap[""]; !ok {
-		upstreamMap[""] = []Upstream{defaultGoogleUpstream}
+		go func() {
+			log.Printf("try to serve http on %s", config.HttpListen)
+			if err := http.ListenAndServe(config.HttpListen, mux); err != nil {
+				log.Fatalf("Failed to setup the http server: %v", err)
+			}
+		}()
 	}
 
 	listenAddr := "127.0.0.1:53"
@@ -311,21 +367,15 @@ func main() {
 		listenAddr = config.Listen
 	}
 
-	var cacheSize uint32 = 1000
-	if config.CacheSize != nil {
-		cacheSize = *config.CacheSize
-	}
-	dnsCache = NewDNSCache(cacheSize)
 	server := &dns.Server{
-		Addr: listenAddr,
-		Net:  "udp",
-		Handler: &MyHandler{
-			upstreamMap: upstreamMap,
-			cache:       dnsCache,
-		},
+		Addr:       listenAddr,
+		Net:        "udp",
+		Handler:    handler,
 		TsigSecret: nil,
 	}
 
+	startReloader(*confFile, config, handler, *watch)
+
 	log.Printf("try to listen on %s", listenAddr)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to setup the server: %v", err)
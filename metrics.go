@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "gdns"
+
+var (
+	metricQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Number of questions served, by query type and response code.",
+	}, []string{"qtype", "rcode"})
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of questions answered from cache.",
+	})
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of questions not found in cache.",
+	})
+	metricUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of exchanges with upstreams.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"upstream"})
+	metricUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of failed exchanges with upstreams, by reason (error or timeout).",
+	}, []string{"upstream", "reason"})
+	metricMyIPRefresh = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "myip_refresh_total",
+		Help:      "Number of public IP refreshes, by result (success or failure).",
+	}, []string{"result"})
+	metricInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_exchanges",
+		Help:      "Number of upstream exchanges in progress.",
+	})
+	metricBlocklistHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocklist_hits_total",
+		Help:      "Number of questions blocked, by list.",
+	}, []string{"list"})
+	metricBlocklistRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocklist_rules",
+		Help:      "Number of rules loaded, by list.",
+	}, []string{"list"})
+	metricDNSSECResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dnssec_results_total",
+		Help:      "Number of upstream answers validated, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricQueries,
+		metricCacheHits,
+		metricCacheMisses,
+		metricUpstreamDuration,
+		metricUpstreamErrors,
+		metricMyIPRefresh,
+		metricInflight,
+		metricBlocklistHits,
+		metricBlocklistRules,
+		metricDNSSECResults,
+	)
+}
+
+func rcodeLabel(m *dns.Msg) string {
+	if m == nil {
+		return "NONE"
+	}
+	if s, ok := dns.RcodeToString[m.Rcode]; ok {
+		return s
+	}
+	return "UNKNOWN"
+}
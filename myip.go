@@ -75,8 +75,10 @@ func (m *MyIP) StartTaobaoIPLoop(cb func(oldIP, newIP net.IP)) {
 		oldIP := m.GetIP()
 		for {
 			if err := m.refreshFromTaobaoIP(); err != nil {
+				metricMyIPRefresh.WithLabelValues("failure").Inc()
 				log.Printf("refresh myip failed: %v", err)
 			} else {
+				metricMyIPRefresh.WithLabelValues("success").Inc()
 				newIP := m.GetIP()
 				if !oldIP.Equal(newIP) {
 					log.Printf("myip changed from %s to %s", oldIP, newIP)
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type QueryLogRecord struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Group    string    `json:"group,omitempty"`
+	ID       uint16    `json:"id"`
+	Index    int       `json:"index"`
+	Total    int       `json:"total"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Route    string    `json:"route"`
+	Upstream string    `json:"upstream,omitempty"`
+	RttMs    int64     `json:"rtt_ms"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Cache    string    `json:"cache"`
+	ECS      string    `json:"ecs,omitempty"`
+	Policy   string    `json:"policy,omitempty"`
+	DNSSEC   string    `json:"dnssec,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type QueryLogSink interface {
+	Log(r *QueryLogRecord)
+}
+
+type QueryLogger struct {
+	sinks []QueryLogSink
+	ring  *RingQueryLog
+}
+
+func NewQueryLogger(configs []QueryLogConfig) (*QueryLogger, error) {
+	if len(configs) == 0 {
+		configs = []QueryLogConfig{{Type: "text"}}
+	}
+	l := new(QueryLogger)
+	for i, c := range configs {
+		var sink QueryLogSink
+		var err error
+		switch c.Type {
+		case "text":
+			sink = TextQueryLog{}
+		case "file":
+			sink, err = NewFileQueryLog(c.Path, int64(c.MaxSizeMB)<<20, c.MaxBackups)
+		case "syslog":
+			sink, err = NewSyslogQueryLog(c.Network, c.Address, c.Tag)
+		case "ring":
+			if l.ring != nil {
+				err = fmt.Errorf("only one ring sink allowed")
+				break
+			}
+			size := c.Size
+			if size <= 0 {
+				size = 1000
+			}
+			l.ring = NewRingQueryLog(size)
+			sink = l.ring
+		default:
+			err = fmt.Errorf("unknown type %q", c.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query_log[%d]: %v", i, err)
+		}
+		l.sinks = append(l.sinks, sink)
+	}
+	return l, nil
+}
+
+func (l *QueryLogger) Log(r *QueryLogRecord) {
+	for _, s := range l.sinks {
+		s.Log(r)
+	}
+}
+
+// Ring returns the in-memory sink, or nil if none is configured.
+func (l *QueryLogger) Ring() *RingQueryLog {
+	return l.ring
+}
+
+// TextQueryLog writes the human-readable format to the standard logger.
+type TextQueryLog struct{}
+
+func (TextQueryLog) Log(r *QueryLogRecord) {
+	target := r.Upstream
+	if r.Cache == "hit" {
+		target = "cache"
+	}
+	if r.Error != "" {
+		log.Printf("%s#%d %d/%d query %v, type=%s => %s rtt=%dms, err=%s", r.Client, r.ID, r.Index, r.Total, r.QName, r.QType, target, r.RttMs, r.Error)
+		return
+	}
+	log.Printf("%s#%d %d/%d query %v, type=%s => %s rtt=%dms, rcode=%s, answers=%d", r.Client, r.ID, r.Index, r.Total, r.QName, r.QType, target, r.RttMs, r.Rcode, r.Answers)
+}
+
+// FileQueryLog writes JSON lines to a file, rotating it to path.1, path.2, ...
+// once it grows beyond maxSize bytes.
+type FileQueryLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func NewFileQueryLog(path string, maxSize int64, maxBackups int) (*FileQueryLog, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no path")
+	}
+	if maxSize <= 0 {
+		maxSize = 100 << 20
+	}
+	if maxBackups <= 0 {
+		maxBackups = 3
+	}
+	l := &FileQueryLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileQueryLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *FileQueryLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+	for i := l.maxBackups - 1; i > 0; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *FileQueryLog) Log(r *QueryLogRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return
+		}
+	}
+	if l.size+int64(len(b)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			log.Printf("rotate query log %s: %v", l.path, err)
+			if l.f == nil {
+				return
+			}
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("write query log %s: %v", l.path, err)
+	}
+}
+
+// RingQueryLog keeps the most recent records in memory.
+type RingQueryLog struct {
+	sync.Mutex
+	records []QueryLogRecord
+	next    int
+	full    bool
+}
+
+func NewRingQueryLog(size int) *RingQueryLog {
+	return &RingQueryLog{
+		records: make([]QueryLogRecord, size),
+	}
+}
+
+func (l *RingQueryLog) Log(r *QueryLogRecord) {
+	l.Lock()
+	l.records[l.next] = *r
+	l.next++
+	if l.next == len(l.records) {
+		l.next = 0
+		l.full = true
+	}
+	l.Unlock()
+}
+
+// Query returns up to limit matching records, newest first.
+func (l *RingQueryLog) Query(match func(r *QueryLogRecord) bool, limit int) []QueryLogRecord {
+	l.Lock()
+	defer l.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.records)
+	}
+	res := []QueryLogRecord{}
+	for i := 0; i < n && len(res) < limit; i++ {
+		idx := l.next - 1 - i
+		if idx < 0 {
+			idx += len(l.records)
+		}
+		if match(&l.records[idx]) {
+			res = append(res, l.records[idx])
+		}
+	}
+	return res
+}
+
+func (l *RingQueryLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	qname, client, qtype, rcode := strings.ToLower(q.Get("qname")), q.Get("client"), strings.ToUpper(q.Get("qtype")), strings.ToUpper(q.Get("rcode"))
+	records := l.Query(func(r *QueryLogRecord) bool {
+		if qname != "" && !strings.Contains(strings.ToLower(r.QName), qname) {
+			return false
+		}
+		if client != "" && !strings.HasPrefix(r.Client, client) {
+			return false
+		}
+		if qtype != "" && r.QType != qtype {
+			return false
+		}
+		if rcode != "" && r.Rcode != rcode {
+			return false
+		}
+		return true
+	}, limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRebindingNets are the private, loopback, link-local and unspecified
+// ranges that public names should never resolve to.
+var defaultRebindingNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// rebindGuard filters upstream answers that point names outside allow at
+// addresses in nets, so that a page from a public site cannot be made to talk
+// to hosts on the local network.
+type rebindGuard struct {
+	action string
+	nets   *IPSet
+	// allow matches internal names, using an empty upstream list as the mark
+	// of a match.
+	allow *routeTable
+}
+
+// newRebindGuard builds the guard from c. Without an allowlist, the names
+// routed by hand in config are taken to be internal, see addMappingNames.
+func newRebindGuard(path string, c *RebindingConfig, config *Config) (*rebindGuard, error) {
+	g := &rebindGuard{
+		action: c.Action,
+		nets:   NewIPSet(),
+		allow:  newRouteTable(nil),
+	}
+	switch c.Action {
+	case "":
+		g.action = "drop"
+	case "drop", "null", "refused":
+	default:
+		return nil, configError(path+".action", fmt.Errorf("want drop, null or refused, got %q", c.Action))
+	}
+	if err := g.nets.AddStrings(path+".nets", defaultRebindingNets); err != nil {
+		return nil, err
+	}
+	if err := g.nets.AddStrings(path+".nets", c.Nets); err != nil {
+		return nil, err
+	}
+	if c.Allow != nil {
+		for i, key := range c.Allow {
+			if err := g.allow.Add(key, []Upstream{}); err != nil {
+				return nil, configError(fmt.Sprintf("%s.allow[%d]", path, i), err)
+			}
+		}
+		return g, nil
+	}
+	if err := addMappingNames(g.allow, config); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *rebindGuard) allowed(name string) bool {
+	_, upstreams := g.allow.Lookup(normalizeDomain(name))
+	return upstreams != nil
+}
+
+// applyRebinding filters r, the upstream answer to question qi of req, as
+// Config.Rebinding says. policy is "rebinding" if it did.
+func (s *HandlerState) applyRebinding(req *dns.Msg, qi int, r *dns.Msg) (reply *dns.Msg, policy string) {
+	g := s.rebinding
+	if g == nil || r == nil {
+		return r, ""
+	}
+	q := req.Question[qi]
+	var bad []string
+	for _, rr := range r.Answer {
+		if ip := answerIP(rr); ip != nil && g.nets.Contains(ip) {
+			bad = append(bad, ip.String())
+		}
+	}
+	if len(bad) == 0 || g.allowed(q.Name) {
+		return r, ""
+	}
+	log.Printf("rebinding: %s %s answered %v, %s", q.Name, dns.TypeToString[q.Qtype], bad, g.action)
+	if g.action == "refused" {
+		return localReply(req, qi, dns.RcodeRefused), "rebinding"
+	}
+	reply = r.Copy()
+	answer := reply.Answer[:0]
+	for _, rr := range reply.Answer {
+		if ip := answerIP(rr); ip != nil && g.nets.Contains(ip) {
+			if g.action == "drop" {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				rr.A = net.IPv4zero
+			case *dns.AAAA:
+				rr.AAAA = net.IPv6zero
+			}
+		}
+		answer = append(answer, rr)
+	}
+	reply.Answer = answer
+	return reply, "rebinding"
+}
+
+func answerIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+const (
+	configWatchInterval = 5 * time.Second
+	// stateDrainDelay is how long a replaced state is kept before waiting for
+	// its queries and closing it.
+	stateDrainDelay = 5 * time.Second
+)
+
+// startReloader reloads the config on SIGHUP, whenever one of the files the
+// config refers to changes and, if watch is set, whenever the config file
+// itself changes. Changes are noticed by modification time. An invalid config
+// is logged and the running state is kept.
+func startReloader(path string, config *Config, h *MyHandler, watch bool) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	modTimes := watchedModTimes(path, h.State(), watch)
+	tick := time.Tick(configWatchInterval)
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				log.Printf("got SIGHUP, reloading %s", path)
+			case <-tick:
+				changed := changedFile(modTimes)
+				if changed == "" {
+					continue
+				}
+				log.Printf("%s changed, reloading %s", changed, path)
+			}
+			if err := reloadConfig(path, config, h); err != nil {
+				log.Printf("reload %s failed, keeping old config: %v", path, err)
+			}
+			modTimes = watchedModTimes(path, h.State(), watch)
+		}
+	}()
+}
+
+func watchedModTimes(path string, s *HandlerState, watch bool) map[string]time.Time {
+	files := s.files
+	if watch {
+		files = append([]string{path}, files...)
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		modTimes[f] = modTime(f)
+	}
+	return modTimes
+}
+
+// changedFile returns one of the files in modTimes that changed, or "".
+func changedFile(modTimes map[string]time.Time) string {
+	for f, t := range modTimes {
+		if !modTime(f).Equal(t) {
+			return f
+		}
+	}
+	return ""
+}
+
+// modTime returns the zero time if path cannot be stat'ed.
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// reloadConfig swaps in a new HandlerState. startup is the config the process
+// was started with, used to warn about settings that cannot be reloaded.
+func reloadConfig(path string, startup *Config, h *MyHandler) error {
+	config, err := GetConfigFromFile(path)
+	if err != nil {
+		return err
+	}
+	state, err := NewHandlerState(config, h.State())
+	if err != nil {
+		return err
+	}
+	if config.Listen != startup.Listen || config.HttpListen != startup.HttpListen || config.MyIP != startup.MyIP || !reflect.DeepEqual(config.QueryLog, startup.QueryLog) {
+		log.Printf("listen, http_listen, myip and query_log changes need a restart to take effect")
+	}
+	old := h.State()
+	h.SetState(state)
+	go old.closeWhenDrained()
+	log.Printf("config reloaded from %s", path)
+	return nil
+}
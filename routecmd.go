@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// routeCommand implements "gdns-go [-conf path] route [-client ip] [-type
+// qtype] name...", printing the rule each name matches and the upstreams it
+// would be sent to, in order.
+func routeCommand(args []string) int {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	fs.StringVar(confFile, "conf", *confFile, "Specify config json path")
+	client := fs.String("client", "", "Route as if queried from this IP")
+	typ := fs.String("type", "A", "Route as if querying this type")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gdns-go [-conf config.json] route [-client ip] [-type qtype] name...")
+		return 2
+	}
+	config, err := GetConfigFromFile(*confFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	inspectOnly = true
+	state, err := NewHandlerState(config, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	qtype, err := parseQtype(*typ)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var group *clientGroup
+	if *client != "" {
+		ip := net.ParseIP(*client)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "invalid client ip %q\n", *client)
+			return 2
+		}
+		group = state.clientGroup(&net.UDPAddr{IP: ip})
+	}
+	for _, name := range fs.Args() {
+		if rule := state.blockedBy(name, group); rule != "" {
+			fmt.Printf("%s\trule=%s\tblocked\n", name, rule)
+			continue
+		}
+		if action := state.typeActions[qtype]; action != "" {
+			fmt.Printf("%s\ttype=%s\tanswered locally: %s\n", name, *typ, action)
+			continue
+		}
+		if r := state.local.Answer(&dns.Msg{Question: []dns.Question{{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}}}, 0); r != nil {
+			fmt.Printf("%s\ttype=%s\tanswered locally: %s\n", name, *typ, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		route, upstreams := state.determineRoute(name, qtype, group)
+		if route == "" {
+			route = "(default)"
+		}
+		names := make([]string, len(upstreams))
+		for i, u := range upstreams {
+			names[i] = u.Name()
+		}
+		if group != nil {
+			fmt.Printf("%s\tgroup=%s\trule=%s\tupstreams=%s\n", name, group.name, route, strings.Join(names, ","))
+		} else {
+			fmt.Printf("%s\trule=%s\tupstreams=%s\n", name, route, strings.Join(names, ","))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// routeTable picks the upstreams for a domain from the mapping keys. The
+// kinds of rule are tried in this order and the first that matches wins:
+//
+//	!rule          any rule below negated; the name takes the default route
+//	exact:domain   the domain only
+//	domain         the domain and its subdomains, longest suffix first; an
+//	               IP or CIDR stands for its in-addr.arpa or ip6.arpa zones
+//	glob:pattern   * matches any run of characters including dots, ? any one;
+//	               a plain key containing * or ? is a glob too
+//	regex:pattern  a Go regular expression, anchored by the pattern if wanted
+//
+// Within globs and within regexes, longer patterns are tried first. All
+// rules match against the lowercased name without its trailing dot.
+type routeTable struct {
+	negations []routeMatcher
+	exact     map[string]routeRule
+	suffixes  domainTrie
+	patterns  []routeRule
+}
+
+type routeRule struct {
+	route     string
+	upstreams []Upstream
+	kind      string
+	pattern   string
+	re        *regexp.Regexp
+}
+
+type routeMatcher struct {
+	route string
+	match func(domain string) bool
+}
+
+func newRouteTable(defaultRoute []Upstream) *routeTable {
+	t := &routeTable{
+		exact: make(map[string]routeRule),
+	}
+	t.suffixes.Insert("", defaultRoute)
+	return t
+}
+
+// parseRouteKey splits a mapping key into its kind and pattern.
+func parseRouteKey(key string) (negate bool, kind, pattern string, err error) {
+	if strings.HasPrefix(key, "!") {
+		negate, key = true, key[1:]
+	}
+	kind, pattern = "suffix", key
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		switch key[:i] {
+		case "exact", "suffix", "glob", "regex":
+			kind, pattern = key[:i], key[i+1:]
+		}
+	}
+	if kind == "suffix" && strings.ContainsAny(pattern, "*?") {
+		kind = "glob"
+	}
+	if kind != "regex" {
+		pattern = normalizeDomain(pattern)
+	}
+	if pattern == "" && (negate || kind != "suffix") {
+		return false, "", "", errors.New("empty pattern")
+	}
+	return
+}
+
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
+
+// Add adds the rule written as key. Upstreams are ignored for negated rules.
+func (t *routeTable) Add(key string, upstreams []Upstream) error {
+	negate, kind, pattern, err := parseRouteKey(key)
+	if err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	switch kind {
+	case "glob":
+		re, err = compileGlob(pattern)
+	case "regex":
+		re, err = regexp.Compile(pattern)
+	}
+	if err != nil {
+		return err
+	}
+	if negate {
+		m := routeMatcher{route: key}
+		switch kind {
+		case "exact":
+			m.match = func(domain string) bool { return domain == pattern }
+		case "suffix":
+			zones := suffixZones(pattern)
+			m.match = func(domain string) bool {
+				for _, z := range zones {
+					if domain == z || strings.HasSuffix(domain, "."+z) {
+						return true
+					}
+				}
+				return false
+			}
+		default:
+			m.match = re.MatchString
+		}
+		t.negations = append(t.negations, m)
+		return nil
+	}
+	switch kind {
+	case "exact":
+		t.exact[pattern] = routeRule{route: key, upstreams: upstreams}
+	case "suffix":
+		for _, z := range suffixZones(pattern) {
+			t.suffixes.Insert(z, upstreams)
+		}
+	default:
+		t.patterns = append(t.patterns, routeRule{route: key, upstreams: upstreams, kind: kind, pattern: pattern, re: re})
+		sort.Slice(t.patterns, func(i, j int) bool {
+			pi, pj := t.patterns[i], t.patterns[j]
+			switch {
+			case pi.kind != pj.kind:
+				return pi.kind == "glob"
+			case len(pi.pattern) != len(pj.pattern):
+				return len(pi.pattern) > len(pj.pattern)
+			}
+			return pi.route < pj.route
+		})
+	}
+	return nil
+}
+
+// suffixZones returns the reverse zones of pattern if it is an IP or CIDR,
+// and pattern itself otherwise.
+func suffixZones(pattern string) []string {
+	if strings.IndexByte(pattern, '.') < 0 && strings.IndexByte(pattern, ':') < 0 {
+		return []string{pattern}
+	}
+	n, err := parseIPNet(pattern)
+	if err != nil {
+		return []string{pattern}
+	}
+	return reverseZones(n)
+}
+
+// reverseZones returns the in-addr.arpa or ip6.arpa zones covering n, one
+// for each value of a partial octet or nibble.
+func reverseZones(n *net.IPNet) []string {
+	ones, _ := n.Mask.Size()
+	ip, width, suffix := n.IP.To4(), 8, "in-addr.arpa"
+	if ip == nil {
+		ip, width, suffix = n.IP.To16(), 4, "ip6.arpa"
+	}
+	digit := func(i int) int {
+		if width == 8 {
+			return int(ip[i])
+		}
+		return int(ip[i/2]>>uint(4*(1-i%2))) & 0xf
+	}
+	format := func(v int) string {
+		if width == 8 {
+			return strconv.Itoa(v)
+		}
+		return strconv.FormatInt(int64(v), 16)
+	}
+	labels := []string{suffix}
+	full := ones / width
+	for i := 0; i < full; i++ {
+		labels = append([]string{format(digit(i))}, labels...)
+	}
+	base := strings.Join(labels, ".")
+	rest := ones % width
+	if rest == 0 {
+		return []string{base}
+	}
+	first := digit(full) &^ (1<<uint(width-rest) - 1)
+	zones := make([]string, 0, 1<<uint(width-rest))
+	for v := first; v < first+1<<uint(width-rest); v++ {
+		zones = append(zones, format(v)+"."+base)
+	}
+	return zones
+}
+
+// Lookup returns the rule matching domain, which must be normalized, and its
+// upstreams. The default route is "".
+func (t *routeTable) Lookup(domain string) (route string, upstreams []Upstream) {
+	for _, m := range t.negations {
+		if m.match(domain) {
+			return m.route, t.suffixes.upstreams
+		}
+	}
+	if r, ok := t.exact[domain]; ok {
+		return r.route, r.upstreams
+	}
+	route, upstreams = t.suffixes.Lookup(domain)
+	if route != "" {
+		return
+	}
+	for _, r := range t.patterns {
+		if r.re.MatchString(domain) {
+			return r.route, r.upstreams
+		}
+	}
+	return
+}
+
+// addMappingNames marks in t, with an empty upstream list, the names routed
+// by hand: the keys of mapping, of each client group's mapping and of
+// type_mapping. The "" keys are left out, and so are the negated keys of
+// client groups and type_mapping, which only send names on to the top-level
+// rules. Domain lists are left out too, as they tend to be long lists of
+// public names.
+func addMappingNames(t *routeTable, config *Config) error {
+	add := func(path string, mapping map[string]UpstreamRefs, negations bool) error {
+		keys := make([]string, 0, len(mapping))
+		for key := range mapping {
+			if key != "" && (negations || !strings.HasPrefix(key, "!")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := t.Add(key, []Upstream{}); err != nil {
+				return configError(fmt.Sprintf("%s[%q]", path, key), err)
+			}
+		}
+		return nil
+	}
+	if err := add("mapping", config.Mapping, true); err != nil {
+		return err
+	}
+	groups := make([]string, 0, len(config.ClientGroups))
+	for name, g := range config.ClientGroups {
+		if g != nil {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		if err := add("client_groups."+name+".mapping", config.ClientGroups[name].Mapping, false); err != nil {
+			return err
+		}
+	}
+	types := make([]string, 0, len(config.TypeMapping))
+	for typ := range config.TypeMapping {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		if err := add("type_mapping."+typ, config.TypeMapping[typ], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newNameSet builds a table matching the names of keys, which take the same
+// syntax as mapping keys, or the names routed by hand in config if keys is
+// nil, see addMappingNames. An empty upstream list marks a match.
+func newNameSet(path string, keys []string, config *Config) (*routeTable, error) {
+	t := newRouteTable(nil)
+	if keys != nil {
+		for i, key := range keys {
+			if err := t.Add(key, []Upstream{}); err != nil {
+				return nil, configError(fmt.Sprintf("%s[%d]", path, i), err)
+			}
+		}
+		return t, nil
+	}
+	if err := addMappingNames(t, config); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// containsName reports whether a table built by newNameSet matches name.
+func (t *routeTable) containsName(name string) bool {
+	_, upstreams := t.Lookup(normalizeDomain(name))
+	return upstreams != nil
+}
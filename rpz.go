@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultRPZRefresh = time.Hour
+
+// RPZ actions, from the CNAME targets that encode them.
+const (
+	rpzNXDOMAIN  = "NXDOMAIN"
+	rpzNODATA    = "NODATA"
+	rpzPASSTHRU  = "PASSTHRU"
+	rpzDROP      = "DROP"
+	rpzLocalData = "local-data"
+)
+
+// RPZ is a response policy zone. It supports QNAME, response IP (rpz-ip) and
+// NSDNAME (rpz-nsdname) triggers; other triggers and rpz-tcp-only are
+// skipped. Zones loaded by AXFR are transferred in the background when built,
+// and again every refresh period once they are used, keeping the old
+// policies if the transfer fails. Until the first transfer succeeds they
+// have those of the zone they replace, or none.
+type RPZ struct {
+	config RPZConfig
+	// transfer is nil for zones read from a file.
+	transfer func() ([]dns.RR, error)
+	refresh  time.Duration
+
+	rules atomic.Value // *rpzRules
+
+	sync.Mutex
+	fetching  bool
+	nextFetch time.Time
+}
+
+type rpzRule struct {
+	zone    string
+	trigger string
+	action  string
+	rrs     []dns.RR
+}
+
+type rpzIPRule struct {
+	net  *net.IPNet
+	bits int
+	rule *rpzRule
+}
+
+type rpzRules struct {
+	zone         string
+	qname        map[string]*rpzRule
+	qnameWild    map[string]*rpzRule
+	nsdname      map[string]*rpzRule
+	nsdnameWild  map[string]*rpzRule
+	ips          []rpzIPRule // longest prefix first
+	count        int
+	skippedCount int
+}
+
+// newRPZRules turns the records of zone into policies.
+func newRPZRules(zone string, rrs []dns.RR) *rpzRules {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	r := &rpzRules{
+		zone:        zone,
+		qname:       make(map[string]*rpzRule),
+		qnameWild:   make(map[string]*rpzRule),
+		nsdname:     make(map[string]*rpzRule),
+		nsdnameWild: make(map[string]*rpzRule),
+	}
+	byOwner := make(map[string][]dns.RR)
+	var owners []string
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		if !strings.HasSuffix(owner, "."+zone) {
+			continue
+		}
+		if _, ok := byOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		byOwner[owner] = append(byOwner[owner], rr)
+	}
+	for _, owner := range owners {
+		rel := strings.TrimSuffix(owner, "."+zone)
+		rule := &rpzRule{zone: zone, trigger: rel, action: rpzLocalData, rrs: byOwner[owner]}
+		if cname, ok := rule.rrs[0].(*dns.CNAME); ok && len(rule.rrs) == 1 {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				rule.action = rpzNXDOMAIN
+			case "*.":
+				rule.action = rpzNODATA
+			case "rpz-passthru.":
+				rule.action = rpzPASSTHRU
+			case "rpz-drop.":
+				rule.action = rpzDROP
+			case "rpz-tcp-only.":
+				r.skippedCount++
+				continue
+			}
+		}
+		name, exact, wild := rel, r.qname, r.qnameWild
+		switch {
+		case strings.HasSuffix(rel, ".rpz-ip"):
+			n, err := parseRPZIP(strings.TrimSuffix(rel, ".rpz-ip"))
+			if err != nil {
+				r.skippedCount++
+				continue
+			}
+			bits, _ := n.Mask.Size()
+			r.ips = append(r.ips, rpzIPRule{n, bits, rule})
+			r.count++
+			continue
+		case strings.HasSuffix(rel, ".rpz-nsdname"):
+			name, exact, wild = strings.TrimSuffix(rel, ".rpz-nsdname"), r.nsdname, r.nsdnameWild
+		case strings.HasSuffix(rel, ".rpz-client-ip"), strings.HasSuffix(rel, ".rpz-nsip"):
+			r.skippedCount++
+			continue
+		}
+		if strings.HasPrefix(name, "*.") {
+			wild[name[2:]] = rule
+		} else {
+			exact[name] = rule
+		}
+		r.count++
+	}
+	sort.SliceStable(r.ips, func(i, j int) bool {
+		return r.ips[i].bits > r.ips[j].bits
+	})
+	return r
+}
+
+// parseRPZIP parses the reversed form of rpz-ip owners, such as
+// 24.0.2.0.192 for 192.0.2.0/24 or 128.1.zz.db8.2001 for 2001:db8::1/128.
+func parseRPZIP(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, errors.New("too short")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, err
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	var addr string
+	if len(parts) == 4 && !strings.Contains(s, "zz") {
+		addr = strings.Join(parts, ".")
+	} else {
+		addr = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(addr, ":") && !strings.HasPrefix(addr, "::") {
+			addr = ":" + addr
+		}
+		if strings.HasSuffix(addr, ":") && !strings.HasSuffix(addr, "::") {
+			addr += ":"
+		}
+	}
+	_, n, err := net.ParseCIDR(addr + "/" + strconv.Itoa(bits))
+	return n, err
+}
+
+func matchRPZName(exact, wild map[string]*rpzRule, name string) *rpzRule {
+	if rule := exact[name]; rule != nil {
+		return rule
+	}
+	if len(wild) == 0 {
+		return nil
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if rule := wild[name]; rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *rpzRules) matchIP(ip net.IP) *rpzRule {
+	for _, ir := range r.ips {
+		if ir.net.Contains(ip) {
+			return ir.rule
+		}
+	}
+	return nil
+}
+
+func (z *RPZ) current() *rpzRules {
+	if z.transfer != nil {
+		z.Lock()
+		start := !z.fetching && !time.Now().Before(z.nextFetch)
+		if start {
+			z.fetching = true
+		}
+		z.Unlock()
+		if start {
+			go z.update()
+		}
+	}
+	return z.rules.Load().(*rpzRules)
+}
+
+func (z *RPZ) update() {
+	rrs, err := z.transfer()
+	z.Lock()
+	z.fetching = false
+	if err != nil {
+		z.nextFetch = time.Now().Add(blocklistRetry)
+	} else {
+		z.nextFetch = time.Now().Add(z.refresh)
+	}
+	z.Unlock()
+	if err != nil {
+		log.Printf("rpz %s: AXFR from %s failed: %v", z.config.Zone, z.config.Server, err)
+		return
+	}
+	z.setRules(newRPZRules(z.config.Zone, rrs))
+}
+
+func (z *RPZ) setRules(r *rpzRules) {
+	z.rules.Store(r)
+	log.Printf("rpz %s: loaded %d policies, skipped %d", r.zone, r.count, r.skippedCount)
+}
+
+// NewRPZ loads the zone described by c, reusing an AXFR zone of old with the
+// same config. An AXFR zone from the same server with another config lends
+// its policies to the new one. path is used in errors.
+func NewRPZ(path string, c RPZConfig, old []*RPZ) (*RPZ, error) {
+	z := &RPZ{
+		config:  c,
+		refresh: time.Duration(c.RefreshMin) * time.Minute,
+	}
+	if z.refresh == 0 {
+		z.refresh = defaultRPZRefresh
+	}
+	switch {
+	case c.File != "" && c.Server != "":
+		return nil, configError(path, errors.New("file and server are exclusive"))
+	case c.File != "":
+		f, err := os.Open(c.File)
+		if err != nil {
+			return nil, configError(path+".file", err)
+		}
+		defer f.Close()
+		origin := c.Zone
+		if origin == "" {
+			origin = "."
+		}
+		var rrs []dns.RR
+		zp := dns.NewZoneParser(f, dns.Fqdn(origin), c.File)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if soa, isSOA := rr.(*dns.SOA); isSOA && c.Zone == "" {
+				z.config.Zone = soa.Hdr.Name
+			}
+			rrs = append(rrs, rr)
+		}
+		if err := zp.Err(); err != nil {
+			return nil, configError(path+".file", err)
+		}
+		if z.config.Zone == "" {
+			return nil, configError(path+".zone", errors.New("missing, and the file has no SOA"))
+		}
+		z.setRules(newRPZRules(z.config.Zone, rrs))
+		return z, nil
+	case c.Server != "":
+		if c.Zone == "" {
+			return nil, configError(path+".zone", errors.New("missing"))
+		}
+		rules := newRPZRules(c.Zone, nil)
+		for _, oz := range old {
+			if oz.transfer == nil {
+				continue
+			}
+			if oz.config == c {
+				return oz, nil
+			}
+			if oz.config.Server == c.Server && oz.config.Zone == c.Zone {
+				rules = oz.rules.Load().(*rpzRules)
+			}
+		}
+		server, err := normalizeHostPort(c.Server, "53")
+		if err != nil {
+			return nil, configError(path+".server", err)
+		}
+		z.transfer = func() ([]dns.RR, error) {
+			m := new(dns.Msg)
+			m.SetAxfr(dns.Fqdn(c.Zone))
+			ch, err := new(dns.Transfer).In(m, server)
+			if err != nil {
+				return nil, err
+			}
+			var rrs []dns.RR
+			for env := range ch {
+				if env.Error != nil {
+					return nil, env.Error
+				}
+				rrs = append(rrs, env.RR...)
+			}
+			return rrs, nil
+		}
+		z.rules.Store(rules)
+		if !inspectOnly {
+			z.fetching = true
+			go z.update()
+		}
+		return z, nil
+	}
+	return nil, configError(path, errors.New("want file or server"))
+}
+
+// applyRPZ checks question qi of req and its answer r, which may be nil,
+// against the policy zones in order, and returns the reply to send instead.
+// The reply is nil if it should be dropped. policy describes the hit, if any.
+func (s *HandlerState) applyRPZ(req *dns.Msg, qi int, r *dns.Msg) (reply *dns.Msg, policy string) {
+	if len(s.rpz) == 0 {
+		return r, ""
+	}
+	q := req.Question[qi]
+	names := []string{normalizeDomain(q.Name)}
+	var ips []net.IP
+	if r != nil {
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				names = append(names, normalizeDomain(rr.Target))
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	var nsNames []string
+	nsLooked := false
+	for _, z := range s.rpz {
+		rules := z.current()
+		var rule *rpzRule
+		for _, name := range names {
+			if rule = matchRPZName(rules.qname, rules.qnameWild, name); rule != nil {
+				break
+			}
+		}
+		for i := 0; rule == nil && i < len(ips); i++ {
+			rule = rules.matchIP(ips[i])
+		}
+		if rule == nil && r != nil && len(rules.nsdname)+len(rules.nsdnameWild) > 0 {
+			if !nsLooked {
+				nsNames, nsLooked = s.nsNames(q.Name, r), true
+			}
+			for _, ns := range nsNames {
+				if rule = matchRPZName(rules.nsdname, rules.nsdnameWild, normalizeDomain(ns)); rule != nil {
+					break
+				}
+			}
+		}
+		if rule == nil {
+			continue
+		}
+		policy = fmt.Sprintf("rpz %s %s %s", strings.TrimSuffix(rule.zone, "."), rule.trigger, rule.action)
+		log.Printf("%s: %s %s", policy, q.Name, dns.TypeToString[q.Qtype])
+		switch rule.action {
+		case rpzPASSTHRU:
+			return r, policy
+		case rpzDROP:
+			return nil, policy
+		case rpzNXDOMAIN:
+			return localReply(req, qi, dns.RcodeNameError), policy
+		}
+		reply = localReply(req, qi, dns.RcodeSuccess)
+		if rule.action == rpzLocalData {
+			for _, rr := range rule.rrs {
+				if t := rr.Header().Rrtype; t == q.Qtype || t == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+					rr = dns.Copy(rr)
+					rr.Header().Name = q.Name
+					reply.Answer = append(reply.Answer, rr)
+				}
+			}
+		}
+		return reply, policy
+	}
+	return r, ""
+}
+
+// nsNames returns the name servers of the zone name is in, from r if it
+// lists them, and otherwise by asking the upstreams.
+func (s *HandlerState) nsNames(name string, r *dns.Msg) []string {
+	collect := func(r *dns.Msg) (ns []string, zone string) {
+		for _, rr := range append(append([]dns.RR{}, r.Answer...), r.Ns...) {
+			switch rr := rr.(type) {
+			case *dns.NS:
+				ns = append(ns, rr.Ns)
+			case *dns.SOA:
+				zone = rr.Hdr.Name
+			}
+		}
+		return
+	}
+	ns, _ := collect(r)
+	if len(ns) > 0 {
+		return ns
+	}
+	nr := s.lookup(name, dns.TypeNS)
+	if nr == nil {
+		return nil
+	}
+	ns, zone := collect(nr)
+	if len(ns) == 0 && zone != "" {
+		if nr = s.lookup(zone, dns.TypeNS); nr != nil {
+			ns, _ = collect(nr)
+		}
+	}
+	return ns
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssPluginRestartDelay is the least time between two starts of a plugin that
+// keeps exiting.
+const ssPluginRestartDelay = 5 * time.Second
+
+var (
+	ssPluginsMu sync.Mutex
+	// ssPlugins maps plugin string and server to the running plugin, shared
+	// by every state using it so a config reload does not start a second copy.
+	ssPlugins = make(map[string]*ssPlugin)
+)
+
+type ssPlugin struct {
+	key    string
+	name   string
+	opts   string
+	server string
+	// refs counts the unreleased startSSPlugin calls for key. It is guarded
+	// by ssPluginsMu.
+	refs int
+
+	sync.Mutex
+	addr string
+	cmd  *exec.Cmd
+	// exited is closed when cmd exits.
+	exited  chan struct{}
+	startAt time.Time
+	stopped bool
+}
+
+// startSSPlugin runs a SIP003 plugin such as "obfs-local;obfs=http" in front
+// of server. The returned addr gives the local address to connect to instead,
+// starting the plugin again if it exited. The plugin is stopped once every
+// caller has called release.
+func startSSPlugin(plugin, server string) (addr func() (string, error), release func(), err error) {
+	if inspectOnly {
+		return func() (string, error) { return server, nil }, func() {}, nil
+	}
+	key := plugin + "|" + server
+	ssPluginsMu.Lock()
+	defer ssPluginsMu.Unlock()
+	p, ok := ssPlugins[key]
+	if !ok {
+		parts := strings.SplitN(plugin, ";", 2)
+		p = &ssPlugin{key: key, name: parts[0], server: server}
+		if len(parts) == 2 {
+			p.opts = parts[1]
+		}
+		p.Lock()
+		err = p.start()
+		p.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		ssPlugins[key] = p
+	}
+	p.refs++
+	var once sync.Once
+	return p.localAddr, func() { once.Do(p.release) }, nil
+}
+
+// localAddr returns the address the plugin listens on, starting it again if
+// it exited.
+func (p *ssPlugin) localAddr() (string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return "", errors.New("plugin stopped")
+	}
+	select {
+	case <-p.exited:
+	default:
+		return p.addr, nil
+	}
+	if wait := p.startAt.Add(ssPluginRestartDelay).Sub(time.Now()); wait > 0 {
+		return "", fmt.Errorf("plugin %s exited, restarting in %v", p.name, wait)
+	}
+	log.Printf("restarting ss plugin %s", p.name)
+	if err := p.start(); err != nil {
+		return "", fmt.Errorf("plugin %s: %v", p.name, err)
+	}
+	return p.addr, nil
+}
+
+func (p *ssPlugin) release() {
+	ssPluginsMu.Lock()
+	p.refs--
+	last := p.refs == 0
+	if last && ssPlugins[p.key] == p {
+		delete(ssPlugins, p.key)
+	}
+	ssPluginsMu.Unlock()
+	if !last {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	p.cmd.Process.Kill()
+}
+
+// start runs the plugin process and waits for it to listen. p must be locked.
+func (p *ssPlugin) start() error {
+	p.startAt = time.Now()
+	remoteHost, remotePort, err := net.SplitHostPort(p.server)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	localAddr := l.Addr().String()
+	l.Close()
+	localHost, localPort, _ := net.SplitHostPort(localAddr)
+
+	cmd := exec.Command(p.name)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+p.opts,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	p.addr, p.cmd, p.exited = localAddr, cmd, exited
+	go func() {
+		err := cmd.Wait()
+		log.Printf("ss plugin %s exited: %v", p.name, err)
+		close(exited)
+	}()
+
+	// Give the plugin a moment to start listening.
+	for i := 0; i < 20; i++ {
+		if conn, err := net.DialTimeout("tcp", localAddr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("%s exited before listening on %s", p.name, localAddr)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	cmd.Process.Kill()
+	return fmt.Errorf("%s is not listening on %s", p.name, localAddr)
+}
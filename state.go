@@ -0,0 +1,880 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+// inspectOnly is set by commands that only inspect the config, so that
+// building a state neither leaves plugin processes behind nor fetches lists.
+var inspectOnly bool
+
+// HandlerState holds everything MyHandler derives from the config. It is
+// immutable once built, so a reload swaps in a new one while in-flight
+// queries keep using the one they started with.
+type HandlerState struct {
+	routes      *routeTable
+	options     map[Upstream]UpstreamOptions
+	loopDomains []string
+	// hostUpstreams shares the udp upstreams made from host[:port] refs.
+	hostUpstreams map[string]Upstream
+	// files are read by the config and watched for changes.
+	files        []string
+	fallback     Upstream
+	queryTimeout time.Duration
+	cache        *DNSCache
+	cacheSize    uint32
+	antiPoison   *AntiPoisonConfig
+	clientGroups []*clientGroup
+	typeRoutes   map[uint16]*routeTable
+	typeActions  map[uint16]string
+	local        *LocalZone
+	// blocklists are sorted by name.
+	blocklists    []*Blocklist
+	blockResponse string
+	rpz           []*RPZ
+	rebinding     *rebindGuard
+	dns64         *DNS64
+	dnssec        *Validator
+	ecsPrefixV4   uint8
+	ecsPrefixV6   uint8
+	ecsClients    []ecsClient
+	// closers free the connection pools and ss plugins made for this state.
+	closers []func()
+	// inflight counts the queries being served from this state.
+	inflight sync.WaitGroup
+}
+
+type UpstreamOptions struct {
+	Timeout time.Duration
+	ECS     ECSPolicy
+	// loopProne upstreams need this resolver to reach their server, so they
+	// must not be used for loopDomains.
+	loopProne bool
+}
+
+type dialFunc func(network, addr string) (net.Conn, error)
+
+// proxySet holds the dialers an upstream can choose from. A nil dialFunc
+// means dialing directly.
+type proxySet struct {
+	global dialFunc
+	named  map[string]dialFunc
+	// specs holds the definitions of the dialers by name, "global" standing
+	// for the global proxy.
+	specs map[string]ProxySpec
+}
+
+// NewHandlerState builds a state from config. If old is not nil, its cache is
+// reused as long as the cache settings did not change.
+func NewHandlerState(config *Config, old *HandlerState) (_ *HandlerState, err error) {
+	s := &HandlerState{
+		options:       make(map[Upstream]UpstreamOptions),
+		loopDomains:   []string{GoogleDnsHttpsDomain},
+		hostUpstreams: make(map[string]Upstream),
+	}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	s.queryTimeout = time.Duration(config.QueryTimeoutSec) * time.Second
+	if s.queryTimeout == 0 {
+		s.queryTimeout = 5 * time.Second
+	}
+
+	s.antiPoison = config.AntiPoison
+	fallbackAntiPoison, err := s.newAntiPoison("", nil)
+	if err != nil {
+		return nil, err
+	}
+	s.fallback = &TcpUdpUpstream{
+		NameServer: AliDNS,
+		Network:    "udp",
+		Dial: (&net.Dialer{
+			Timeout: s.queryTimeout,
+		}).Dial,
+		Timeout:    s.queryTimeout,
+		AntiPoison: fallbackAntiPoison,
+	}
+
+	proxies := &proxySet{
+		named: make(map[string]dialFunc),
+		specs: map[string]ProxySpec{"global": config.Proxy},
+	}
+	if proxies.global, err = s.newProxyDial(config.Proxy); err != nil {
+		return nil, configError("proxy", err)
+	}
+	for name, spec := range config.Proxies {
+		if name == "direct" || name == "global" {
+			return nil, configError("proxies."+name, errors.New("name is reserved"))
+		}
+		if len(spec) == 0 {
+			return nil, configError("proxies."+name, errors.New("missing url"))
+		}
+		if proxies.named[name], err = s.newProxyDial(spec); err != nil {
+			return nil, configError("proxies."+name, err)
+		}
+		proxies.specs[name] = spec
+	}
+	dial := proxies.global
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).Dial
+	}
+	defaultGoogleUpstream := &GoogleHttpsUpstream{
+		Client: newHttpsClient(dial, nil, 2*time.Second),
+	}
+	s.options[defaultGoogleUpstream] = UpstreamOptions{
+		Timeout:   s.queryTimeout,
+		loopProne: true,
+	}
+
+	named := make(map[string]Upstream)
+	names := make([]string, 0, len(config.Upstreams))
+	for name := range config.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "upstreams." + name
+		if name == "default" {
+			return nil, configError(path, errors.New("name is reserved"))
+		}
+		if config.Upstreams[name] == nil {
+			return nil, configError(path, errors.New("must be an object"))
+		}
+		u, err := s.newUpstream(path, config.Upstreams[name], proxies)
+		if err != nil {
+			return nil, err
+		}
+		named[name] = u
+	}
+
+	defaultRoute := []Upstream{defaultGoogleUpstream}
+	if refs, ok := config.Mapping[""]; ok {
+		upstreams, err := s.resolveRefs(`mapping[""]`, refs, named, defaultGoogleUpstream)
+		if err != nil {
+			return nil, err
+		}
+		if len(upstreams) > 0 {
+			defaultRoute = upstreams
+		}
+	}
+	if config.ChinaDNS != nil {
+		u, err := s.newChinaDNS("chinadns", config.ChinaDNS, named, defaultGoogleUpstream, defaultRoute)
+		if err != nil {
+			return nil, err
+		}
+		defaultRoute = []Upstream{u}
+	}
+	s.routes = newRouteTable(defaultRoute)
+	for i, c := range config.DomainLists {
+		if err := s.addDomainList(fmt.Sprintf("domain_lists[%d]", i), c, named, defaultGoogleUpstream, defaultRoute); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.addMapping("mapping", s.routes, config.Mapping, named, defaultGoogleUpstream); err != nil {
+		return nil, err
+	}
+	s.typeRoutes = make(map[uint16]*routeTable)
+	for typ, mapping := range config.TypeMapping {
+		path := "type_mapping." + typ
+		qtype, err := parseQtype(typ)
+		if err != nil {
+			return nil, configError(path, err)
+		}
+		if len(mapping[""]) > 0 {
+			return nil, configError(path+`[""]`, errors.New("a default route is not allowed here"))
+		}
+		routes := newRouteTable(nil)
+		if err := s.addMapping(path, routes, mapping, named, defaultGoogleUpstream); err != nil {
+			return nil, err
+		}
+		s.typeRoutes[qtype] = routes
+	}
+	s.typeActions = make(map[uint16]string)
+	for typ, action := range config.TypeActions {
+		path := "type_actions." + typ
+		qtype, err := parseQtype(typ)
+		if err != nil {
+			return nil, configError(path, err)
+		}
+		switch action {
+		case "empty", "nxdomain", "refused", "rfc8482":
+		default:
+			return nil, configError(path, fmt.Errorf("want empty, nxdomain, refused or rfc8482, got %q", action))
+		}
+		s.typeActions[qtype] = action
+	}
+
+	if config.Local != nil {
+		if s.local, err = NewLocalZoneFromConfig("local", config.Local); err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, config.Local.HostsFiles...)
+		s.files = append(s.files, config.Local.ZoneFiles...)
+	}
+
+	blocklistNames := make([]string, 0, len(config.Blocklists))
+	for name := range config.Blocklists {
+		blocklistNames = append(blocklistNames, name)
+	}
+	sort.Strings(blocklistNames)
+	for _, name := range blocklistNames {
+		path := "blocklists." + name
+		if config.Blocklists[name] == nil {
+			return nil, configError(path, errors.New("must be an object"))
+		}
+		b, err := s.newBlocklist(path, name, config.Blocklists[name], proxies, old)
+		if err != nil {
+			return nil, err
+		}
+		s.blocklists = append(s.blocklists, b)
+	}
+	switch config.BlockResponse {
+	case "", "nxdomain", "null", "refused":
+		s.blockResponse = config.BlockResponse
+	default:
+		return nil, configError("block_response", fmt.Errorf("want nxdomain, null or refused, got %q", config.BlockResponse))
+	}
+
+	s.ecsPrefixV4, s.ecsPrefixV6 = defaultECSPrefixV4, defaultECSPrefixV6
+	if config.ECSPrefixV4 != nil {
+		if *config.ECSPrefixV4 > 32 {
+			return nil, configError("ecs_prefix_v4", fmt.Errorf("want at most 32, got %d", *config.ECSPrefixV4))
+		}
+		s.ecsPrefixV4 = *config.ECSPrefixV4
+	}
+	if config.ECSPrefixV6 != nil {
+		if *config.ECSPrefixV6 > 128 {
+			return nil, configError("ecs_prefix_v6", fmt.Errorf("want at most 128, got %d", *config.ECSPrefixV6))
+		}
+		s.ecsPrefixV6 = *config.ECSPrefixV6
+	}
+	if s.ecsClients, err = newECSClients("ecs_clients", config.ECSClients); err != nil {
+		return nil, err
+	}
+
+	var oldRPZ []*RPZ
+	if old != nil {
+		oldRPZ = old.rpz
+	}
+	for i, c := range config.RPZ {
+		z, err := NewRPZ(fmt.Sprintf("rpz[%d]", i), c, oldRPZ)
+		if err != nil {
+			return nil, err
+		}
+		if c.File != "" {
+			s.files = append(s.files, c.File)
+		}
+		s.rpz = append(s.rpz, z)
+	}
+	if config.Rebinding != nil {
+		if s.rebinding, err = newRebindGuard("rebinding", config.Rebinding, config); err != nil {
+			return nil, err
+		}
+	}
+	if config.DNSSEC != nil {
+		if s.dnssec, err = NewValidator("dnssec", config.DNSSEC, config, s.lookup); err != nil {
+			return nil, err
+		}
+	}
+	if config.DNS64 != nil {
+		if s.dns64, err = NewDNS64("dns64", config.DNS64); err != nil {
+			return nil, err
+		}
+	}
+
+	s.cacheSize = 1000
+	if config.CacheSize != nil {
+		s.cacheSize = *config.CacheSize
+	}
+	if old != nil && old.cacheSize == s.cacheSize {
+		s.cache = old.cache
+	} else {
+		s.cache = NewDNSCache(s.cacheSize)
+	}
+	if err := s.newClientGroups(config, named, defaultGoogleUpstream, old); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close frees what s holds that a new state does not share. Queries must no
+// longer be served from s.
+func (s *HandlerState) Close() {
+	for _, f := range s.closers {
+		f()
+	}
+}
+
+// closeWhenDrained closes s after the queries that started on it finish.
+func (s *HandlerState) closeWhenDrained() {
+	// A query may have loaded s just before it was swapped out but not yet
+	// have counted itself.
+	time.Sleep(stateDrainDelay)
+	s.inflight.Wait()
+	s.Close()
+}
+
+func configError(path string, err error) error {
+	return fmt.Errorf("%s: %v", path, err)
+}
+
+// normalizeHostPort appends defaultPort to addr if it has none.
+func normalizeHostPort(addr, defaultPort string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if !strings.Contains(err.Error(), "missing port in address") {
+			return "", err
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+	return addr, nil
+}
+
+// resolveRefs turns mapping values into upstreams. A host[:port] that is not
+// an upstream name becomes a udp upstream.
+func (s *HandlerState) resolveRefs(path string, refs UpstreamRefs, named map[string]Upstream, defaultUpstream Upstream) ([]Upstream, error) {
+	upstreams := []Upstream{}
+	for i, v := range refs {
+		var upstream Upstream
+		if v == "default" {
+			upstream = defaultUpstream
+		} else if u, ok := named[v]; ok {
+			upstream = u
+		} else {
+			addr, err := normalizeHostPort(v, "53")
+			if err != nil {
+				return nil, configError(fmt.Sprintf("%s[%d]", path, i), fmt.Errorf("%q is neither an upstream name nor a valid dns server: %v", v, err))
+			}
+			if upstream = s.hostUpstreams[addr]; upstream == nil {
+				antiPoison, _ := s.newAntiPoison("", nil)
+				upstream = &TcpUdpUpstream{
+					NameServer: addr,
+					Network:    "udp",
+					Dial: (&net.Dialer{
+						Timeout: s.queryTimeout,
+					}).Dial,
+					Timeout:    s.queryTimeout,
+					AntiPoison: antiPoison,
+				}
+				s.hostUpstreams[addr] = upstream
+			}
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// addMapping adds the rules of mapping other than "" to routes.
+func (s *HandlerState) addMapping(path string, routes *routeTable, mapping map[string]UpstreamRefs, named map[string]Upstream, defaultUpstream Upstream) error {
+	for k, refs := range mapping {
+		if k == "" {
+			continue
+		}
+		keyPath := fmt.Sprintf("%s[%q]", path, k)
+		if strings.HasPrefix(k, "!") {
+			if len(refs) > 0 {
+				return configError(keyPath, errors.New("must be empty for a negated rule"))
+			}
+			if err := routes.Add(k, nil); err != nil {
+				return configError(keyPath, err)
+			}
+			continue
+		}
+		upstreams, err := s.resolveRefs(keyPath, refs, named, defaultUpstream)
+		if err != nil {
+			return err
+		}
+		if len(upstreams) > 0 {
+			if err := routes.Add(k, upstreams); err != nil {
+				return configError(keyPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addDomainList routes the domains read from c.Path. A server of # on a line
+// stands for defaultRoute.
+func (s *HandlerState) addDomainList(path string, c DomainListConfig, named map[string]Upstream, defaultUpstream Upstream, defaultRoute []Upstream) error {
+	if c.Path == "" {
+		return configError(path+".path", errors.New("missing"))
+	}
+	s.files = append(s.files, c.Path)
+	var upstreams []Upstream
+	if len(c.Upstream) > 0 {
+		var err error
+		if upstreams, err = s.resolveRefs(path+".upstream", c.Upstream, named, defaultUpstream); err != nil {
+			return err
+		}
+	}
+	entries, err := readDomainList(c.Path, c.Format)
+	if err != nil {
+		return configError(path, err)
+	}
+	// Lines naming the same servers share one slice of upstreams.
+	byServers := make(map[string][]Upstream)
+	for _, e := range entries {
+		ups := upstreams
+		if ups == nil {
+			key := strings.Join(e.servers, " ")
+			var ok bool
+			if ups, ok = byServers[key]; !ok {
+				linePath := fmt.Sprintf("%s:%d", c.Path, e.line)
+				switch key {
+				case "":
+					return configError(path, configError(linePath, errors.New("no server on this line and no upstream set")))
+				case "#":
+					ups = defaultRoute
+				default:
+					if ups, err = s.resolveRefs(linePath, e.servers, named, defaultUpstream); err != nil {
+						return configError(path, err)
+					}
+				}
+				byServers[key] = ups
+			}
+		}
+		s.routes.suffixes.Insert(e.domain, ups)
+	}
+	return nil
+}
+
+// newChinaDNS builds the ChinaDNSUpstream replacing the default route, whose
+// upstreams so far are the default for c.Trusted.
+func (s *HandlerState) newChinaDNS(path string, c *ChinaDNSConfig, named map[string]Upstream, defaultUpstream Upstream, trusted []Upstream) (Upstream, error) {
+	domestic, err := s.resolveRefs(path+".domestic", c.Domestic, named, defaultUpstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(domestic) == 0 {
+		return nil, configError(path+".domestic", errors.New("missing"))
+	}
+	if len(c.Trusted) > 0 {
+		if trusted, err = s.resolveRefs(path+".trusted", c.Trusted, named, defaultUpstream); err != nil {
+			return nil, err
+		}
+	}
+	cnNets := NewIPSet()
+	if c.CNIPFile != "" {
+		s.files = append(s.files, c.CNIPFile)
+		if err := cnNets.AddFile(c.CNIPFile); err != nil {
+			return nil, configError(path+".cn_ip_file", err)
+		}
+	}
+	if err := cnNets.AddStrings(path+".cn_ips", c.CNIPs); err != nil {
+		return nil, err
+	}
+	if cnNets.Len() == 0 {
+		return nil, configError(path, errors.New("cn_ip_file and cn_ips are both empty"))
+	}
+
+	u := &ChinaDNSUpstream{
+		Domestic: domestic,
+		Trusted:  trusted,
+		CNNets:   cnNets,
+		Options:  s.upstreamOptions,
+	}
+	// The members apply their own ECS policy, and the race lasts as long as
+	// the slower side tries all of its upstreams.
+	opts := UpstreamOptions{
+		ECS: ECSPolicy{passOn: true},
+	}
+	for _, side := range [][]Upstream{domestic, trusted} {
+		var total time.Duration
+		for _, m := range side {
+			mo := s.upstreamOptions(m)
+			total += mo.Timeout
+			opts.loopProne = opts.loopProne || mo.loopProne
+			opts.ECS.Client = opts.ECS.Client || mo.ECS.Client
+		}
+		if total > opts.Timeout {
+			opts.Timeout = total
+		}
+	}
+	s.options[u] = opts
+	return u, nil
+}
+
+// newProxyDial returns nil if spec is empty.
+func (s *HandlerState) newProxyDial(spec ProxySpec) (dialFunc, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(spec))
+	dials := make([]func(network, addr string) (net.Conn, error), len(spec))
+	for i, chain := range spec {
+		var dial dialFunc
+		var hops []string
+		for j, rawurl := range chain {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, fmt.Errorf("[%d][%d]: invalid proxy url %s: %v", i, j, rawurl, err)
+			}
+			var release func()
+			if dial, release, err = NewDialFromURL(u, dial); err != nil {
+				return nil, fmt.Errorf("[%d][%d]: %v", i, j, err)
+			}
+			if release != nil {
+				s.closers = append(s.closers, release)
+			}
+			// Only the first hop is dialed by name from this host.
+			if j == 0 {
+				s.addLoopDomain(u.Hostname())
+			}
+			hops = append(hops, ProxyDisplayName(u))
+		}
+		names[i], dials[i] = strings.Join(hops, " -> "), dial
+	}
+	if len(dials) == 1 {
+		return dials[0], nil
+	}
+	return NewFailoverDial(names, dials).Dial, nil
+}
+
+func (s *HandlerState) addLoopDomain(host string) {
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	host = normalizeDomain(host)
+	for _, d := range s.loopDomains {
+		if d == host {
+			return
+		}
+	}
+	s.loopDomains = append(s.loopDomains, host)
+}
+
+// selectDial resolves an upstream's proxy setting, see UpstreamConfig.
+func (s *HandlerState) selectDial(spec string, defaultGlobal bool, proxies *proxySet) (dialFunc, error) {
+	switch spec {
+	case "":
+		if defaultGlobal {
+			return proxies.global, nil
+		}
+		return nil, nil
+	case "direct":
+		return nil, nil
+	case "global":
+		return proxies.global, nil
+	}
+	if dial, ok := proxies.named[spec]; ok {
+		return dial, nil
+	}
+	if strings.Contains(spec, "://") {
+		return s.newProxyDial(ProxySpec{{spec}})
+	}
+	return nil, fmt.Errorf("unknown proxy %q, want direct, global, a name from proxies or an url", spec)
+}
+
+func (s *HandlerState) newUpstream(path string, c *UpstreamConfig, proxies *proxySet) (Upstream, error) {
+	opts := UpstreamOptions{
+		Timeout: s.queryTimeout,
+	}
+	if c.TimeoutMs > 0 {
+		opts.Timeout = time.Duration(c.TimeoutMs) * time.Millisecond
+	}
+	var err error
+	if opts.ECS, err = ParseECSPolicy(c.ECS); err != nil {
+		return nil, configError(path+".ecs", err)
+	}
+	dial, err := s.selectDial(c.Proxy, c.Type == "doh" || c.Type == "json", proxies)
+	if err != nil {
+		return nil, configError(path+".proxy", err)
+	}
+	if dial != nil {
+		opts.loopProne = true
+	}
+	directDial := (&net.Dialer{
+		Timeout: opts.Timeout,
+	}).Dial
+	var tlsConfig *tls.Config
+	if c.TLS != nil {
+		if c.Type != "dot" && c.Type != "doh" && c.Type != "json" {
+			return nil, configError(path+".tls", errors.New("only applies to type dot, doh and json"))
+		}
+		if tlsConfig, err = newTLSConfig(path+".tls", c.TLS); err != nil {
+			return nil, err
+		}
+	}
+	if c.AntiPoison != nil && c.Type != "udp" {
+		return nil, configError(path+".anti_poison", errors.New("only applies to type udp"))
+	}
+	if c.Address == "" && c.Type != "json" {
+		return nil, configError(path+".address", errors.New("missing"))
+	}
+
+	var u Upstream
+	switch c.Type {
+	case "udp", "tcp":
+		if c.Type == "udp" && dial != nil {
+			return nil, configError(path+".proxy", errors.New("proxies only carry tcp, use type tcp, dot, doh or json"))
+		}
+		addr, err := normalizeHostPort(c.Address, "53")
+		if err != nil {
+			return nil, configError(path+".address", err)
+		}
+		if dial == nil {
+			dial = directDial
+		}
+		t := &TcpUdpUpstream{
+			NameServer: addr,
+			Network:    c.Type,
+			Dial:       dial,
+			Timeout:    opts.Timeout,
+		}
+		if c.Type == "tcp" {
+			t.Pool = s.newTcpPool(t, c)
+		} else if t.AntiPoison, err = s.newAntiPoison(path+".anti_poison", c.AntiPoison); err != nil {
+			return nil, err
+		}
+		u = t
+	case "dot":
+		addr, err := normalizeHostPort(c.Address, "853")
+		if err != nil {
+			return nil, configError(path+".address", err)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		if net.ParseIP(host) == nil {
+			opts.loopProne = true
+			s.addLoopDomain(host)
+		}
+		if dial == nil {
+			dial = directDial
+		}
+		t := &TcpUdpUpstream{
+			NameServer: addr,
+			Network:    "tcp-tls",
+			Dial:       dial,
+			Timeout:    opts.Timeout,
+			TLSConfig:  tlsConfig,
+		}
+		t.Pool = s.newTcpPool(t, c)
+		u = t
+	case "doh", "json":
+		rawurl := c.Address
+		if rawurl == "" {
+			rawurl = GoogleDnsHttpsUrl
+		}
+		ru, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, configError(path+".address", err)
+		}
+		if ru.Scheme != "https" || ru.Host == "" {
+			return nil, configError(path+".address", fmt.Errorf("want an https url, got %q", rawurl))
+		}
+		s.addLoopDomain(ru.Hostname())
+		opts.loopProne = true
+		if dial == nil {
+			dial = directDial
+		}
+		client := newHttpsClient(dial, tlsConfig, opts.Timeout)
+		if c.Type == "doh" {
+			u = &DohUpstream{
+				Client: client,
+				URL:    rawurl,
+			}
+		} else {
+			u = &GoogleHttpsUpstream{
+				Client: client,
+				URL:    rawurl,
+			}
+		}
+	case "":
+		return nil, configError(path+".type", errors.New("missing"))
+	default:
+		return nil, configError(path+".type", fmt.Errorf("unknown type %q, want udp, tcp, dot, doh or json", c.Type))
+	}
+	s.options[u] = opts
+	return u, nil
+}
+
+// newAntiPoison builds an AntiPoison from c, or from the top-level config if
+// c is nil. Each udp upstream needs its own, as it keeps per-server cookie
+// state. It returns nil if neither is set.
+func (s *HandlerState) newAntiPoison(path string, c *AntiPoisonConfig) (*AntiPoison, error) {
+	if c == nil {
+		c, path = s.antiPoison, "anti_poison"
+	}
+	if c == nil {
+		return nil, nil
+	}
+	return NewAntiPoison(path, c)
+}
+
+// newTcpPool returns nil if pooling is disabled for c.
+func (s *HandlerState) newTcpPool(t *TcpUdpUpstream, c *UpstreamConfig) *TcpPool {
+	size := 2
+	if c.PoolSize != nil {
+		size = *c.PoolSize
+	}
+	if size <= 0 {
+		return nil
+	}
+	p := &TcpPool{
+		Dial: func() (net.Conn, error) {
+			return t.dial(t.Network)
+		},
+		Size:        size,
+		IdleTimeout: time.Duration(c.IdleTimeoutMs) * time.Millisecond,
+		Timeout:     t.Timeout,
+	}
+	s.closers = append(s.closers, p.Close)
+	return p
+}
+
+func newTLSConfig(path string, c *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, configError(path+".ca_file", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, configError(path+".ca_file", errors.New("no certificates found"))
+		}
+	}
+	return tlsConfig, nil
+}
+
+func newHttpsClient(dial dialFunc, tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return tls.Client(conn, cfg), nil
+			},
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: timeout,
+	}
+}
+
+func (s *HandlerState) upstreamOptions(u Upstream) UpstreamOptions {
+	if opts, ok := s.options[u]; ok {
+		return opts
+	}
+	return UpstreamOptions{
+		Timeout: s.queryTimeout,
+	}
+}
+
+// determineRoute picks the upstreams for a query, trying the rules of g if it
+// is not nil, then those for qtype, then the top-level ones.
+func (s *HandlerState) determineRoute(domain string, qtype uint16, g *clientGroup) (route string, u []Upstream) {
+	domain = normalizeDomain(domain)
+	if g != nil && g.routes != nil {
+		route, u = g.routes.Lookup(domain)
+	}
+	if t := s.typeRoutes[qtype]; u == nil && t != nil {
+		if route, u = t.Lookup(domain); u != nil {
+			route = dns.TypeToString[qtype] + " " + route
+		}
+	}
+	if u == nil {
+		route, u = s.routes.Lookup(domain)
+	}
+	if s.isLoopDomain(domain) {
+		ups := []Upstream{}
+		for _, up := range u {
+			if !s.upstreamOptions(up).loopProne {
+				ups = append(ups, up)
+			}
+		}
+		if len(ups) > 0 {
+			u = ups
+		} else {
+			u = []Upstream{s.fallback}
+		}
+	}
+	return
+}
+
+// ecsSource returns what ECS policies draw on for a query from client.
+func (s *HandlerState) ecsSource(client net.Addr) ECSSource {
+	ip := addrIP(client)
+	return ECSSource{
+		Detected: myIP.GetIP(),
+		Client:   ip,
+		Mapped:   mappedSubnet(s.ecsClients, ip),
+		PrefixV4: s.ecsPrefixV4,
+		PrefixV6: s.ecsPrefixV6,
+	}
+}
+
+// lookup resolves a question for the server's own use, through the shared
+// cache and the routes, and returns nil if no upstream answers.
+func (s *HandlerState) lookup(name string, qtype uint16) *dns.Msg {
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	if r := s.cache.Get(q, ""); r != nil {
+		return r
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, qtype)
+	if s.dnssec != nil {
+		setDNSSECOK(m)
+	}
+	_, ups := s.determineRoute(q.Name, qtype, nil)
+	for _, u := range ups {
+		opts := s.upstreamOptions(u)
+		if r, _, err := exchange(context.Background(), u, m, opts.Timeout); err == nil {
+			s.cache.Put(q, "", r)
+			return r
+		}
+	}
+	return nil
+}
+
+// parseQtype parses a query type name such as "AAAA" or "TYPE65".
+func parseQtype(s string) (uint16, error) {
+	if qtype, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+		return qtype, nil
+	}
+	if strings.HasPrefix(strings.ToUpper(s), "TYPE") {
+		if v, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return uint16(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown query type %q", s)
+}
+
+// isLoopDomain reports whether domain is or is under one of loopDomains.
+func (s *HandlerState) isLoopDomain(domain string) bool {
+	for _, d := range s.loopDomains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
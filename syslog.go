@@ -0,0 +1,31 @@
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+type SyslogQueryLog struct {
+	w *syslog.Writer
+}
+
+func NewSyslogQueryLog(network, addr, tag string) (*SyslogQueryLog, error) {
+	if tag == "" {
+		tag = "gdns-go"
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogQueryLog{w}, nil
+}
+
+func (l *SyslogQueryLog) Log(r *QueryLogRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	l.w.Info(string(b))
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func NewSyslogQueryLog(network, addr, tag string) (QueryLogSink, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoolIdleTimeout = 10 * time.Second
+	poolMinBackoff         = time.Second
+	poolMaxBackoff         = 30 * time.Second
+	// maxPipelined is how many queries may be outstanding on one connection
+	// before the pool prefers opening another one.
+	maxPipelined = 64
+)
+
+var (
+	errConnClosed = errors.New("connection closed")
+	errPoolClosed = errors.New("pool closed")
+)
+
+// TcpPool keeps up to Size persistent stream connections to one server and
+// pipelines queries on them (RFC 7766), matching replies by ID so they may
+// arrive out of order. It asks for edns-tcp-keepalive (RFC 7828) and honors the
+// idle timeout the server hands back. After a failed dial it refuses to dial
+// again for a backoff period.
+type TcpPool struct {
+	Dial        func() (net.Conn, error)
+	Size        int
+	IdleTimeout time.Duration
+	Timeout     time.Duration
+
+	dialMu sync.Mutex
+
+	sync.Mutex
+	conns   []*pooledConn
+	backoff time.Duration
+	retryAt time.Time
+	closed  bool
+}
+
+type pendingQuery struct {
+	q  dns.Question
+	ch chan *dns.Msg
+}
+
+type pooledConn struct {
+	pool *TcpPool
+	co   *dns.Conn
+
+	writeMu sync.Mutex
+
+	sync.Mutex
+	pending     map[uint16]*pendingQuery
+	closed      bool
+	idleTimeout time.Duration
+	lastUsed    time.Time
+	idleTimer   *time.Timer
+}
+
+// Exchange sends m on a pooled connection. A connection the server closed
+// while idle is only noticed on use, so the query is retried once on another.
+func (p *TcpPool) Exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
+	for i := 0; i < 2; i++ {
+		var c *pooledConn
+		if c, err = p.get(ctx); err != nil {
+			return nil, fmt.Errorf("Dial: %v", err)
+		}
+		if r, err = c.exchange(ctx, m); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return r, err
+}
+
+// pick returns the least loaded connection, and whether it should be used
+// rather than dialing a new one.
+func (p *TcpPool) pick() (best *pooledConn, ok bool) {
+	bestLoad := 0
+	for _, c := range p.conns {
+		if load := c.load(); best == nil || load < bestLoad {
+			best, bestLoad = c, load
+		}
+	}
+	size := p.Size
+	if size <= 0 {
+		size = 1
+	}
+	return best, best != nil && (bestLoad < maxPipelined || len(p.conns) >= size)
+}
+
+func (p *TcpPool) get(ctx context.Context) (*pooledConn, error) {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return nil, errPoolClosed
+	}
+	if best, ok := p.pick(); ok {
+		p.Unlock()
+		return best, nil
+	}
+	p.Unlock()
+
+	// Only one dial at a time, so that a burst of queries shares the new
+	// connection instead of each opening its own.
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	p.Lock()
+	best, ok := p.pick()
+	if ok {
+		p.Unlock()
+		return best, nil
+	}
+	if wait := p.retryAt.Sub(time.Now()); wait > 0 {
+		p.Unlock()
+		if best != nil {
+			return best, nil
+		}
+		return nil, fmt.Errorf("backing off for %v after dial failure", wait)
+	}
+	p.Unlock()
+
+	conn, err := dialContext(ctx, p.Dial)
+
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		if p.backoff == 0 {
+			p.backoff = poolMinBackoff
+		} else if p.backoff *= 2; p.backoff > poolMaxBackoff {
+			p.backoff = poolMaxBackoff
+		}
+		p.retryAt = time.Now().Add(p.backoff)
+		return nil, err
+	}
+	if p.closed {
+		conn.Close()
+		return nil, errPoolClosed
+	}
+	p.backoff, p.retryAt = 0, time.Time{}
+	// Reads wait for as long as the connection stays open, which the idle
+	// timer and close decide, and each write sets its own deadline.
+	conn.SetDeadline(time.Time{})
+	idleTimeout := p.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	c := &pooledConn{
+		pool:        p,
+		co:          &dns.Conn{Conn: conn},
+		pending:     make(map[uint16]*pendingQuery),
+		idleTimeout: idleTimeout,
+		lastUsed:    time.Now(),
+	}
+	c.idleTimer = time.AfterFunc(idleTimeout, c.closeIfIdle)
+	p.conns = append(p.conns, c)
+	go c.readLoop()
+	return c, nil
+}
+
+// Close closes the pooled connections, failing their pending queries, and
+// stops p from dialing new ones.
+func (p *TcpPool) Close() {
+	p.Lock()
+	p.closed = true
+	conns := append([]*pooledConn(nil), p.conns...)
+	p.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+func (p *TcpPool) remove(c *pooledConn) {
+	p.Lock()
+	defer p.Unlock()
+	for i, cc := range p.conns {
+		if cc == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *pooledConn) load() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.pending)
+}
+
+func (c *pooledConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	m = m.Copy()
+	if o := m.IsEdns0(); o != nil {
+		hasKeepalive := false
+		for _, opt := range o.Option {
+			if _, ok := opt.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				hasKeepalive = true
+			}
+		}
+		if !hasKeepalive {
+			o.Option = append(o.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		}
+	} else {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		o := m.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, errConnClosed
+	}
+	id := uint16(rand.Intn(0x10000))
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id++
+	}
+	c.pending[id] = &pendingQuery{m.Question[0], ch}
+	c.lastUsed = time.Now()
+	c.Unlock()
+	defer c.forget(id)
+
+	oldId := m.Id
+	m.Id = id
+	c.writeMu.Lock()
+	c.co.SetWriteDeadline(time.Now().Add(c.pool.Timeout))
+	err := c.co.WriteMsg(m)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("WriteMsg: %v", err)
+	}
+
+	select {
+	case r := <-ch:
+		if r == nil {
+			return nil, fmt.Errorf("ReadMsg: %v", errConnClosed)
+		}
+		r.Id = oldId
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pooledConn) forget(id uint16) {
+	c.Lock()
+	delete(c.pending, id)
+	c.lastUsed = time.Now()
+	if len(c.pending) == 0 && !c.closed {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	c.Unlock()
+}
+
+func (c *pooledConn) readLoop() {
+	for {
+		r, err := c.co.ReadMsg()
+		if err != nil {
+			c.close()
+			return
+		}
+		if o := r.IsEdns0(); o != nil {
+			for _, opt := range o.Option {
+				if ka, ok := opt.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+					c.Lock()
+					c.idleTimeout = time.Duration(ka.Timeout) * 100 * time.Millisecond
+					c.Unlock()
+				}
+			}
+		}
+		c.Lock()
+		pq, ok := c.pending[r.Id]
+		if ok && len(r.Question) == 1 && r.Question[0].Qtype == pq.q.Qtype && strings.EqualFold(r.Question[0].Name, pq.q.Name) {
+			delete(c.pending, r.Id)
+		} else {
+			ok = false
+		}
+		c.Unlock()
+		if ok {
+			pq.ch <- r
+		}
+	}
+}
+
+// closeIfIdle closes c if it has not been used for its idle timeout, and
+// otherwise waits for the rest of it. Connections with pending queries are
+// left to forget, which arms the timer again once the last one is done.
+func (c *pooledConn) closeIfIdle() {
+	c.Lock()
+	if c.closed || len(c.pending) > 0 {
+		c.Unlock()
+		return
+	}
+	if wait := c.lastUsed.Add(c.idleTimeout).Sub(time.Now()); wait > 0 {
+		c.idleTimer.Reset(wait)
+		c.Unlock()
+		return
+	}
+	c.Unlock()
+	c.close()
+}
+
+// close fails every pending query and removes c from its pool.
+func (c *pooledConn) close() {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[uint16]*pendingQuery)
+	c.idleTimer.Stop()
+	c.Unlock()
+	c.pool.remove(c)
+	c.co.Close()
+	for _, pq := range pending {
+		pq.ch <- nil
+	}
+}
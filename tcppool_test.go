@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDoTServer runs a DNS over TLS server answering every query with an
+// empty reply, and returns its address and a config trusting it.
+func startDoTServer(t *testing.T) (addr string, tlsConfig *tls.Config) {
+	// httptest generates a certificate for 127.0.0.1 and a pool trusting it.
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := hs.TLS.Certificates[0]
+	roots := hs.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	hs.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener:    l,
+		Net:         "tcp-tls",
+		IdleTimeout: func() time.Duration { return time.Minute },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return l.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+}
+
+// A pooled DoT connection must outlive the handshake deadline.
+func TestTcpPoolKeepsTLSConn(t *testing.T) {
+	addr, tlsConfig := startDoTServer(t)
+	u := &TcpUdpUpstream{
+		NameServer: addr,
+		Network:    "tcp-tls",
+		Dial:       directDial,
+		Timeout:    200 * time.Millisecond,
+		TLSConfig:  tlsConfig,
+	}
+	u.Pool = &TcpPool{
+		Dial:        func() (net.Conn, error) { return u.dial(u.Network) },
+		Size:        1,
+		IdleTimeout: 10 * time.Second,
+		Timeout:     u.Timeout,
+	}
+	defer u.Pool.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if _, err := u.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	u.Pool.Lock()
+	first := u.Pool.conns[0]
+	u.Pool.Unlock()
+	time.Sleep(3 * u.Timeout)
+	if _, err := u.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	u.Pool.Lock()
+	defer u.Pool.Unlock()
+	if len(u.Pool.conns) != 1 || u.Pool.conns[0] != first {
+		t.Error("the pool dialed a new connection")
+	}
+}
+
+// A connection whose idle timer fires early, while it was in use, must still
+// be closed once it has been idle long enough.
+func TestTcpPoolClosesIdleConn(t *testing.T) {
+	addr, tlsConfig := startDoTServer(t)
+	u := &TcpUdpUpstream{
+		NameServer: addr,
+		Network:    "tcp-tls",
+		Dial:       directDial,
+		Timeout:    time.Second,
+		TLSConfig:  tlsConfig,
+	}
+	p := &TcpPool{
+		Dial:        func() (net.Conn, error) { return u.dial(u.Network) },
+		Size:        1,
+		IdleTimeout: 200 * time.Millisecond,
+		Timeout:     u.Timeout,
+	}
+	defer p.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if _, err := p.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	c := p.conns[0]
+	p.Unlock()
+	// Fire the timer before the idle timeout is over.
+	c.idleTimer.Stop()
+	c.closeIfIdle()
+	time.Sleep(2 * p.IdleTimeout)
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if !closed {
+		t.Error("the idle connection was not closed")
+	}
+}
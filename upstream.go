@@ -1,29 +1,89 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Upstream answers a single-question message. Exchange must return once ctx
+// is done, releasing any connection or request it holds.
 type Upstream interface {
 	Name() string
-	Exchange(m *dns.Msg) (r *dns.Msg, err error)
+	Exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error)
 }
 
+// dialContext runs dial in the background so that ctx can abandon it. A
+// connection established after ctx is done is closed right away.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial()
+		ch <- dialResult{conn, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// closeOnDone closes conn when ctx is done, unblocking any read or write.
+// Calling the returned function stops watching.
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// DefaultUDPSize is the EDNS0 UDP buffer size advertised to upstreams, as
+// recommended by DNS flag day 2020.
+const DefaultUDPSize = 1232
+
+// TcpUdpUpstream speaks plain DNS over Network. If TLSConfig is set, Network
+// must be "tcp-tls" and the connection is wrapped in TLS (DNS over TLS). Over
+// udp it advertises UDPSize (DefaultUDPSize if zero) and retries over tcp when
+// the reply is truncated, guarded by AntiPoison if set. Over tcp and tcp-tls,
+// queries go through Pool if set.
 type TcpUdpUpstream struct {
 	NameServer string
 	Network    string
 	Dial       func(network, addr string) (net.Conn, error)
+	Timeout    time.Duration
+	TLSConfig  *tls.Config
+	UDPSize    uint16
+	Pool       *TcpPool
+	AntiPoison *AntiPoison
 	trId       uint32
 }
 
@@ -31,24 +91,80 @@ func (t *TcpUdpUpstream) Name() string {
 	return t.Network + "://" + t.NameServer
 }
 
-func (t *TcpUdpUpstream) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
-	co := new(dns.Conn)
-	if co.Conn, err = t.Dial(t.Network, t.NameServer); err != nil {
+func (t *TcpUdpUpstream) dial(network string) (net.Conn, error) {
+	if t.TLSConfig == nil {
+		return t.Dial(network, t.NameServer)
+	}
+	conn, err := t.Dial("tcp", t.NameServer)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, t.TLSConfig)
+	tlsConn.SetDeadline(time.Now().Add(t.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The deadline only bounds the handshake; callers set their own.
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t *TcpUdpUpstream) Exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
+	if t.Network != "udp" {
+		if t.Pool != nil {
+			return t.Pool.Exchange(ctx, m)
+		}
+		return t.exchange(ctx, t.Network, m, 0)
+	}
+	udpSize := t.UDPSize
+	if udpSize == 0 {
+		udpSize = DefaultUDPSize
+	}
+	m = m.Copy()
+	setEdns0UDPSize(m, udpSize)
+	if t.AntiPoison != nil {
+		r, err = t.exchangeGuarded(ctx, m, udpSize)
+	} else {
+		r, err = t.exchange(ctx, "udp", m, udpSize)
+	}
+	if err == nil && r.Truncated {
+		return t.exchange(ctx, "tcp", m, 0)
+	}
+	return r, err
+}
+
+func (t *TcpUdpUpstream) exchange(ctx context.Context, network string, m *dns.Msg, udpSize uint16) (r *dns.Msg, err error) {
+	co := &dns.Conn{
+		UDPSize: udpSize,
+	}
+	if co.Conn, err = dialContext(ctx, func() (net.Conn, error) { return t.dial(network) }); err != nil {
 		return nil, fmt.Errorf("Dial: %v", err)
 	}
 	defer co.Close()
+	defer closeOnDone(ctx, co)()
+	deadline := time.Now().Add(t.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
 	oldId := m.Id
 	m.Id = uint16(atomic.AddUint32(&t.trId, 1))
 	defer func() {
 		m.Id = oldId
 	}()
-	co.SetWriteDeadline(time.Now().Add(dnsQueryTimeoutSec))
+	co.SetWriteDeadline(deadline)
 	if err = co.WriteMsg(m); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, fmt.Errorf("WriteMsg: %v", err)
 	}
-	co.SetReadDeadline(time.Now().Add(dnsQueryTimeoutSec))
+	co.SetReadDeadline(deadline)
 	r, err = co.ReadMsg()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		err = fmt.Errorf("ReadMsg: %v", err)
 	}
 	if r != nil {
@@ -57,16 +173,41 @@ func (t *TcpUdpUpstream) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
 	return r, err
 }
 
+// setEdns0UDPSize advertises at least size, adding an OPT record if needed.
+func setEdns0UDPSize(m *dns.Msg, size uint16) {
+	if o := m.IsEdns0(); o != nil {
+		if o.UDPSize() < size {
+			o.SetUDPSize(size)
+		}
+		return
+	}
+	m.SetEdns0(size, false)
+}
+
+// clientUDPSize returns the largest reply a client can take over udp.
+func clientUDPSize(m *dns.Msg) int {
+	if o := m.IsEdns0(); o != nil && o.UDPSize() > dns.MinMsgSize {
+		return int(o.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
 const (
 	GoogleDnsHttpsDomain = "dns.google.com"
 	GoogleDnsHttpsUrl    = "https://" + GoogleDnsHttpsDomain + "/resolve"
 )
 
+// GoogleHttpsUpstream speaks the JSON API of Google Public DNS. URL defaults
+// to GoogleDnsHttpsUrl.
 type GoogleHttpsUpstream struct {
 	Client *http.Client
+	URL    string
 }
 
 func (g *GoogleHttpsUpstream) Name() string {
+	if g.URL != "" {
+		return g.URL
+	}
 	return GoogleDnsHttpsUrl
 }
 
@@ -110,30 +251,43 @@ type GoogleDnsHttpsResponse struct {
 	Comment string
 }
 
-func extractRRHdr(a GoogleDnsHttpsAnswer) dns.RR_Header {
-	return dns.RR_Header{
-		Name:   a.Name,
-		Rrtype: a.Type,
-		Ttl:    a.TTL,
-		Class:  dns.ClassINET,
+// RR parses a, whose data is in presentation format, or returns nil if it
+// cannot be parsed.
+func (a GoogleDnsHttpsAnswer) RR() dns.RR {
+	typ, ok := dns.TypeToString[a.Type]
+	if !ok {
+		typ = "TYPE" + strconv.Itoa(int(a.Type))
 	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(a.Name), a.TTL, typ, a.Data))
+	if err != nil {
+		return nil
+	}
+	return rr
 }
 
-func (g *GoogleHttpsUpstream) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
+func (g *GoogleHttpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
 	params := url.Values{
 		"name": {m.Question[0].Name},
 		"type": {strconv.FormatUint(uint64(m.Question[0].Qtype), 10)},
 	}
+	// Signatures and denial records only come back with do, and cd makes
+	// the upstream hand over answers that fail its own validation.
+	if o := m.IsEdns0(); o != nil && o.Do() {
+		params.Set("do", "1")
+	}
+	if m.CheckingDisabled {
+		params.Set("cd", "1")
+	}
 	edns0Subnet := extractEdns0Subnet(m)
 	if edns0Subnet != nil && edns0Subnet.Address != nil {
 		params.Set("edns_client_subnet", edns0Subnet.Address.String()+"/"+strconv.Itoa(int(edns0Subnet.SourceNetmask)))
 	}
-	reqUrl := GoogleDnsHttpsUrl + "?" + params.Encode()
+	reqUrl := g.Name() + "?" + params.Encode()
 	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := g.Client.Do(req)
+	resp, err := g.Client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -157,287 +311,65 @@ func (g *GoogleHttpsUpstream) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
 	r.MsgHdr.Truncated = msgResp.TC
 	r.MsgHdr.RecursionDesired = msgResp.RD
 	r.MsgHdr.RecursionAvailable = msgResp.RA
+	r.MsgHdr.AuthenticatedData = msgResp.AD
 	r.MsgHdr.CheckingDisabled = msgResp.CD
 	for _, q := range msgResp.Question {
 		r.Question = append(r.Question, dns.Question{q.Name, q.Type, dns.ClassINET})
 	}
 	for _, a := range msgResp.Answer {
-		hdr := extractRRHdr(a)
-		var rr dns.RR
-		switch a.Type {
-		case dns.TypeA:
-			rr = &dns.A{
-				Hdr: hdr,
-				A:   net.ParseIP(a.Data),
-			}
-		case dns.TypeNS:
-			rr = &dns.NS{
-				Hdr: hdr,
-				Ns:  a.Data,
-			}
-		case dns.TypeMD:
-			rr = &dns.MD{
-				Hdr: hdr,
-				Md:  a.Data,
-			}
-		case dns.TypeMF:
-			rr = &dns.MF{
-				Hdr: hdr,
-				Mf:  a.Data,
-			}
-		case dns.TypeCNAME:
-			rr = &dns.CNAME{
-				Hdr:    hdr,
-				Target: a.Data,
-			}
-		case dns.TypeSOA:
-		case dns.TypeMB:
-			rr = &dns.MB{
-				Hdr: hdr,
-				Mb:  a.Data,
-			}
-		case dns.TypeMG:
-			rr = &dns.MG{
-				Hdr: hdr,
-				Mg:  a.Data,
-			}
-		case dns.TypeMR:
-			rr = &dns.MR{
-				Hdr: hdr,
-				Mr:  a.Data,
-			}
-		case dns.TypeNULL:
-		case dns.TypePTR:
-			rr = &dns.PTR{
-				Hdr: hdr,
-				Ptr: a.Data,
-			}
-		case dns.TypeHINFO:
-		case dns.TypeMINFO:
-		case dns.TypeMX:
-			mx := &dns.MX{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 2 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 16)
-			mx.Preference = uint16(n)
-			mx.Mx = parts[1]
-			rr = mx
-		case dns.TypeTXT:
-			rr = &dns.TXT{
-				Hdr: hdr,
-				Txt: strings.Split(a.Data, " "),
-			}
-		case dns.TypeRP:
-			rp := &dns.RP{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 2 {
-				continue
-			}
-			rp.Mbox, rp.Txt = parts[0], parts[1]
-			rr = rp
-		case dns.TypeAAAA:
-			rr = &dns.AAAA{
-				Hdr:  hdr,
-				AAAA: net.ParseIP(a.Data),
-			}
-		case dns.TypeSRV:
-			srv := &dns.SRV{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 4 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 16)
-			srv.Priority = uint16(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 16)
-			srv.Weight = uint16(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 16)
-			srv.Port = uint16(n)
-			srv.Target = parts[3]
-			rr = srv
-		case dns.TypeSPF:
-			rr = &dns.SPF{
-				Hdr: hdr,
-				Txt: strings.Split(a.Data, " "),
-			}
-		case dns.TypeDS:
-			ds := &dns.DS{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 4 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 16)
-			ds.KeyTag = uint16(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			ds.Algorithm = uint8(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 8)
-			ds.DigestType = uint8(n)
-			ds.Digest = parts[3]
-			rr = ds
-		case dns.TypeSSHFP:
-			sshfp := &dns.SSHFP{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 3 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 8)
-			sshfp.Algorithm = uint8(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			sshfp.Type = uint8(n)
-			sshfp.FingerPrint = parts[2]
-			rr = sshfp
-		case dns.TypeRRSIG:
-			rrsig := &dns.RRSIG{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 9 {
-				continue
-			}
-			var ok bool
-			if rrsig.TypeCovered, ok = dns.StringToType[strings.ToUpper(parts[0])]; !ok {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			rrsig.Algorithm = uint8(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 8)
-			rrsig.Labels = uint8(n)
-			n, _ = strconv.ParseUint(parts[3], 10, 32)
-			rrsig.OrigTtl = uint32(n)
-			n, _ = strconv.ParseUint(parts[4], 10, 32)
-			rrsig.Expiration = uint32(n)
-			n, _ = strconv.ParseUint(parts[5], 10, 32)
-			rrsig.Inception = uint32(n)
-			n, _ = strconv.ParseUint(parts[6], 10, 16)
-			rrsig.KeyTag = uint16(n)
-			rrsig.SignerName = parts[7]
-			rrsig.Signature = parts[8]
-			rr = rrsig
-		case dns.TypeNSEC:
-			nsec := &dns.NSEC{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			nsec.NextDomain = parts[0]
-			for _, d := range parts[1:] {
-				if typeBit, ok := dns.StringToType[strings.ToUpper(d)]; ok {
-					nsec.TypeBitMap = append(nsec.TypeBitMap, typeBit)
-				}
-			}
-			rr = nsec
-		case dns.TypeDNSKEY:
-			dnskey := &dns.DNSKEY{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 4 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 16)
-			dnskey.Flags = uint16(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			dnskey.Protocol = uint8(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 8)
-			dnskey.Algorithm = uint8(n)
-			dnskey.PublicKey = parts[3]
-			rr = dnskey
-		case dns.TypeNSEC3:
-			nsec3 := &dns.NSEC3{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 7 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 8)
-			nsec3.Hash = uint8(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			nsec3.Flags = uint8(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 16)
-			nsec3.Iterations = uint16(n)
-			n, _ = strconv.ParseUint(parts[3], 10, 8)
-			nsec3.SaltLength = uint8(n)
-			nsec3.Salt = parts[4]
-			n, _ = strconv.ParseUint(parts[5], 10, 8)
-			nsec3.HashLength = uint8(n)
-			nsec3.NextDomain = parts[6]
-			for _, d := range parts[7:] {
-				if t, ok := dns.StringToType[strings.ToUpper(d)]; ok {
-					nsec3.TypeBitMap = append(nsec3.TypeBitMap, t)
-				}
-			}
-			rr = nsec3
-		case dns.TypeNSEC3PARAM:
-			nsec3param := &dns.NSEC3PARAM{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 5 {
-				continue
-			}
-			var n uint64
-			n, _ = strconv.ParseUint(parts[0], 10, 8)
-			nsec3param.Hash = uint8(n)
-			n, _ = strconv.ParseUint(parts[1], 10, 8)
-			nsec3param.Flags = uint8(n)
-			n, _ = strconv.ParseUint(parts[2], 10, 16)
-			nsec3param.Iterations = uint16(n)
-			n, _ = strconv.ParseUint(parts[3], 10, 8)
-			nsec3param.SaltLength = uint8(n)
-			nsec3param.Salt = parts[4]
-			rr = nsec3param
-		}
-		if rr != nil {
+		if rr := a.RR(); rr != nil {
 			r.Answer = append(r.Answer, rr)
 		}
 	}
 	for _, a := range msgResp.Authority {
-		hdr := extractRRHdr(a)
-		var rr dns.RR
-		switch a.Type {
-		case dns.TypeSOA:
-			soa := &dns.SOA{
-				Hdr: hdr,
-			}
-			parts := strings.Split(a.Data, " ")
-			if len(parts) < 7 {
-				continue
-			}
-			soa.Ns = parts[0]
-			soa.Mbox = parts[1]
-			var n uint64
-			n, _ = strconv.ParseUint(parts[2], 10, 32)
-			soa.Serial = uint32(n)
-			n, _ = strconv.ParseUint(parts[3], 10, 32)
-			soa.Refresh = uint32(n)
-			n, _ = strconv.ParseUint(parts[4], 10, 32)
-			soa.Retry = uint32(n)
-			n, _ = strconv.ParseUint(parts[5], 10, 32)
-			soa.Expire = uint32(n)
-			n, _ = strconv.ParseUint(parts[6], 10, 32)
-			soa.Minttl = uint32(n)
-			rr = soa
+		if rr := a.RR(); rr != nil {
+			r.Ns = append(r.Ns, rr)
 		}
-		r.Ns = append(r.Ns, rr)
 	}
 	err = nil
 	return
 }
+
+// DohUpstream speaks DNS over HTTPS (RFC 8484) with POST requests.
+type DohUpstream struct {
+	Client *http.Client
+	URL    string
+}
+
+func (d *DohUpstream) Name() string {
+	return d.URL
+}
+
+func (d *DohUpstream) Exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
+	oldId := m.Id
+	m.Id = 0
+	buf, err := m.Pack()
+	m.Id = oldId
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status=%s", resp.Status)
+	}
+	respBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r = new(dns.Msg)
+	if err := r.Unpack(respBytes); err != nil {
+		return nil, err
+	}
+	r.Id = oldId
+	return r, nil
+}